@@ -0,0 +1,236 @@
+package coapmq
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Options and response codes of blockwise transfer (RFC 7959), not defined in go-coap
+const (
+	BLOCK2 coap.OptionID = 23
+	BLOCK1 coap.OptionID = 27
+	SIZE2  coap.OptionID = 28
+
+	//2.31 Continue, ask client to send next Block1
+	CONTINUE coap.COAPCode = 95
+	//4.08 Request Entity Incomplete, Block1 not in sequence
+	REQUEST_ENTITY_INCOMPLETE coap.COAPCode = 136
+)
+
+//Default block size of broker and client, it keep message within one UDP datagram
+const DEFAULT_BLOCK_SIZE = 1024
+
+//Block option value, Size is 16 to 1024 in power of 2
+type Block struct {
+	Num  uint32
+	More bool
+	Size int
+}
+
+//Decode Block1 or Block2 option value: NUM << 4 | M << 3 | SZX
+func ParseBlock(v uint32) Block {
+	return Block{Num: v >> 4, More: v&0x8 != 0, Size: 1 << ((v & 0x7) + 4)}
+}
+
+//Encode block to option value
+func (b Block) Value() uint32 {
+	v := b.Num<<4 | uint32(blockSZX(b.Size))
+	if b.More {
+		v |= 0x8
+	}
+	return v
+}
+
+//Return SZX of block size, size not in power of 2 is rounded down
+func blockSZX(size int) int {
+	szx := 0
+	for szx < 6 && 1<<uint(szx+5) <= size {
+		szx++
+	}
+	return szx
+}
+
+//Round block size to valid value 16~1024 in power of 2, 0 for default size
+func validBlockSize(size int) int {
+	if size <= 0 {
+		size = DEFAULT_BLOCK_SIZE
+	}
+	return 1 << uint(blockSZX(size)+4)
+}
+
+//Return Block1 or Block2 option of message
+func BlockOption(m *coap.Message, id coap.OptionID) (Block, bool) {
+	switch v := m.Option(id).(type) {
+	case uint32:
+		return ParseBlock(v), true
+	case int:
+		return ParseBlock(uint32(v)), true
+	}
+	return Block{}, false
+}
+
+//Return the num block of payload, and if there is more block after it
+func sliceBlock(payload []byte, num uint32, size int) ([]byte, bool, error) {
+	start := int(num) * size
+	if start > len(payload) || (start == len(payload) && start > 0) {
+		return nil, false, errors.New("Block out of range")
+	}
+	end := start + size
+	if end >= len(payload) {
+		return payload[start:], false, nil
+	}
+	return payload[start:end], true, nil
+}
+
+//Entity tag of value, so client know value not changed between blocks
+func valueETag(value []byte) []byte {
+	tag := make([]byte, 4)
+	binary.BigEndian.PutUint32(tag, crc32.ChecksumIEEE(value))
+	return tag
+}
+
+//Set first or requested block of value on response, if value is larger than block size
+//Return false if requested block is out of range.
+func setBlock2(rv *coap.Message, value []byte, req *coap.Message, blockSize int) bool {
+	block, requested := Block{Size: blockSize}, false
+	if req != nil {
+		if b, exist := BlockOption(req, BLOCK2); exist {
+			block, requested = b, true
+			//Client could ask for smaller block only
+			if block.Size > blockSize {
+				block.Num = block.Num * uint32(block.Size/blockSize)
+				block.Size = blockSize
+			}
+		}
+	}
+	if !requested && len(value) <= blockSize {
+		return true
+	}
+
+	payload, more, err := sliceBlock(value, block.Num, block.Size)
+	if err != nil {
+		return false
+	}
+	rv.Payload = payload
+	rv.SetOption(BLOCK2, Block{Num: block.Num, More: more, Size: block.Size}.Value())
+	rv.SetOption(coap.ETag, valueETag(value))
+	if block.Num == 0 {
+		rv.SetOption(SIZE2, uint32(len(value)))
+	}
+	return true
+}
+
+//Parse message with Block1, Block2 and Size2 options, go-coap drop options it not know
+func parseMessage(data []byte) (*coap.Message, error) {
+	m, err := coap.ParseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	for id, v := range rawUintOptions(data, BLOCK2, BLOCK1, SIZE2) {
+		if m.Option(id) == nil {
+			m.SetOption(id, v)
+		}
+	}
+	return &m, nil
+}
+
+//Scan option values of ids from raw message, message must be already validated by go-coap
+func rawUintOptions(data []byte, ids ...coap.OptionID) map[coap.OptionID]uint32 {
+	ret := make(map[coap.OptionID]uint32)
+	b := data[4+int(data[0]&0xf):]
+	ext := func(v int) int {
+		switch v {
+		case 13:
+			v = int(b[0]) + 13
+			b = b[1:]
+		case 14:
+			v = int(binary.BigEndian.Uint16(b[:2])) + 269
+			b = b[2:]
+		}
+		return v
+	}
+
+	prev := 0
+	for len(b) > 0 && b[0] != 0xff {
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		delta = ext(delta)
+		length = ext(length)
+		id := coap.OptionID(prev + delta)
+		prev += delta
+		for _, want := range ids {
+			if id == want && length <= 4 {
+				var v uint32
+				for _, c := range b[:length] {
+					v = v<<8 | uint32(c)
+				}
+				ret[id] = v
+			}
+		}
+		b = b[length:]
+	}
+	return ret
+}
+
+//Partial Block1 payload from one client on one topic
+type blockTransfer struct {
+	payload []byte
+	updated time.Time
+}
+
+//Receive Block1 of publish, return full payload when last block arrive
+//Return response message for other blocks (2.31) or any error, caller send it directly.
+func (c *Broker) receiveBlock1(a *net.UDPAddr, m *coap.Message, topic string) ([]byte, *coap.Message) {
+	block, exist := BlockOption(m, BLOCK1)
+	if !exist {
+		return m.Payload, nil
+	}
+
+	c.blockLock.Lock()
+	defer c.blockLock.Unlock()
+
+	//Drop transfer not finished in exchange lifetime
+	now := time.Now()
+	for key, t := range c.blockTransfers {
+		if now.Sub(t.updated) > exchangeLifetime {
+			delete(c.blockTransfers, key)
+		}
+	}
+
+	key := a.String() + " " + topic
+	t, exist := c.blockTransfers[key]
+	if block.Num == 0 {
+		t = &blockTransfer{}
+		c.blockTransfers[key] = t
+	} else if !exist || len(t.payload) != int(block.Num)*block.Size {
+		delete(c.blockTransfers, key)
+		return nil, c.response(a, REQUEST_ENTITY_INCOMPLETE, nil, m)
+	}
+	t.payload = append(t.payload, m.Payload...)
+	t.updated = now
+
+	if c.MaxPayloadSize > 0 && len(t.payload) > c.MaxPayloadSize {
+		delete(c.blockTransfers, key)
+		rv := c.response(a, coap.RequestEntityTooLarge, nil, m)
+		rv.SetOption(coap.Size1, uint32(c.MaxPayloadSize))
+		return nil, rv
+	}
+
+	if block.More {
+		//Ask for next block, broker could ask smaller block size on it
+		size := block.Size
+		if max := validBlockSize(c.BlockSize); size > max {
+			size = max
+		}
+		rv := c.response(a, CONTINUE, nil, m)
+		rv.SetOption(BLOCK1, Block{Num: block.Num, More: true, Size: size}.Value())
+		return nil, rv
+	}
+	delete(c.blockTransfers, key)
+	return t.payload, nil
+}
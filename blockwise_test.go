@@ -0,0 +1,103 @@
+package coapmq_test
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/kkdai/coapmq"
+)
+
+func TestBlockOptionValue(t *testing.T) {
+	for _, b := range []Block{{Num: 0, More: true, Size: 16}, {Num: 5, More: false, Size: 1024}, {Num: 1 << 19, More: true, Size: 256}} {
+		if got := ParseBlock(b.Value()); got != b {
+			t.Error("Block round trip failed:", b, got)
+		}
+	}
+	//NUM=2, M=1, SZX=6 (1024)
+	if v := (Block{Num: 2, More: true, Size: 1024}).Value(); v != 0x2e {
+		t.Errorf("Wrong block value: %#x", v)
+	}
+}
+
+func TestBrokerBlock1Size(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	//Broker block size, Block1 size from client, size broker should ask for next block
+	for k, sizes := range [][3]int{{0, 64, 64}, {0, 1024, 1024}, {256, 1024, 256}, {256, 64, 64}} {
+		broker := newBroker(t)
+		broker.BlockSize = sizes[0]
+		broker.ServeCOAP(nil, client, wireMessage(t, EncodeCmd(PUBSUB_PATH, uint16(k*10), NewCmd(CMD_CREATE, "firmware", nil))))
+
+		m := EncodeCmd(PUBSUB_PATH, uint16(k*10+1), NewCmd(CMD_PUBLISH, "firmware", blockPayload(sizes[1])))
+		m.SetOption(BLOCK1, Block{Num: 0, More: true, Size: sizes[1]}.Value())
+		//Not through wireMessage, go-coap drop Block1 option on parse
+		rv := broker.ServeCOAP(nil, client, m)
+		if rv == nil || rv.Code != CONTINUE {
+			t.Fatal("Block1 should get 2.31 Continue:", sizes, rv)
+		}
+		if b, _ := BlockOption(rv, BLOCK1); b.Size != sizes[2] {
+			t.Error("Wrong Block1 size of next block:", sizes, b.Size)
+		}
+	}
+}
+
+func blockPayload(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	//Make sure NUL byte inside
+	data[size/2] = 0
+	return data
+}
+
+func TestClientBlockwise(t *testing.T) {
+	for _, sizes := range [][2]int{{1024, 1024}, {64, 1024}, {1024, 256}} {
+		broker := newBroker(t)
+		broker.BlockSize = sizes[1]
+		conn := serveBroker(t, broker)
+
+		client := newClient(t, conn.LocalAddr().String())
+		client.BlockSize = sizes[0]
+		if _, err := client.CreateTopic("firmware", nil); err != nil {
+			t.Fatal("Create topic failed:", err)
+		}
+		ch, err := client.SubscriptionBytes("firmware")
+		if err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+
+		data := blockPayload(5000)
+		if err := client.PublishBytes("firmware", data); err != nil {
+			t.Fatal("Publish large value failed:", sizes, err)
+		}
+		if val, err := client.ReadTopicBytes("firmware"); err != nil || !bytes.Equal(val, data) {
+			t.Error("Read large value failed:", sizes, len(val), err)
+		}
+		select {
+		case val := <-ch:
+			if !bytes.Equal(val, data) {
+				t.Error("Notification of large value failed:", sizes, len(val))
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("No notification of large value:", sizes)
+		}
+		conn.Close()
+	}
+}
+
+func TestClientBlockwiseTooLarge(t *testing.T) {
+	broker := newBroker(t)
+	broker.MaxPayloadSize = 2000
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("firmware", nil)
+	if err := client.PublishBytes("firmware", blockPayload(3000)); err == nil {
+		t.Error("Publish over payload limit by blocks should fail")
+	}
+	if val, err := client.ReadTopicBytes("firmware"); err != nil || len(val) != 0 {
+		t.Error("Rejected publish should not change value:", len(val), err)
+	}
+}
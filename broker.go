@@ -1,105 +1,280 @@
 package coapmq
 
 import (
+	"context"
 	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dustin/go-coap"
 )
 
-type chanMapStringList map[*net.UDPAddr][]string
-type stringMapChanList map[string][]*net.UDPAddr
+type clientMapStringList map[string][]string
 
 type Broker struct {
-	//The default maximal map size
+	//Maximal topic count, create more topic get 5.03. 0 for unlimited
 	Capacity int
-
-	msgIndex uint16 //for increase and sync message ID
-
-	//map to store "chan -> Topic List" for find subscription
-	clientMapTopics chanMapStringList
-	//map to store "topic -> chan List" for publish
-	topicMapClients stringMapChanList
-	//Store all topic list and its latest value
-	topicMapValue map[string]string
+	//Maximal subscriptions from one client address, 0 for unlimited
+	MaxClientSubscriptions int
+	//Maximal subscribers on one topic filter, 0 for unlimited
+	MaxTopicSubscribers int
+	//Maximal payload bytes of topic value, publish larger value get 4.13. 0 for unlimited
+	MaxPayloadSize int
+	//Initial timeout to wait ACK of confirmable notification, double on each retransmit
+	AckTimeout time.Duration
+	//Maximal retransmit of a notification, observer is evicted after that
+	MaxRetransmit int
+	//Send 5.03 Service Unavailable to all observers when shutdown, so they know to register again
+	NotifyOnShutdown bool
+	//Time to keep response of confirmable request for duplicate detection, default EXCHANGE_LIFETIME
+	ExchangeLifetime time.Duration
+	//Block size of blockwise transfer (RFC 7959) for large value, 16 to 1024 in power of 2
+	//Only work with Serve, go-coap drop Block options when serve by coap.Serve.
+	BlockSize int
+	//Values kept in history of each topic, 0 disable history
+	HistorySize int
+	//Drop values older than it from history, 0 keep HistorySize values regardless of age
+	HistoryAge time.Duration
+	//Remove topic not used (create, publish, read or subscribe) within it, 0 keep topic forever
+	//Topic could have its own lifetime in seconds by "lt" attribute on create.
+	TopicLifetime time.Duration
+	//Read topic after its value expired by Max-Age get 4.04, default get empty value same as new topic
+	ExpiredValueNotFound bool
+	//Time source of topic lifetime, value Max-Age and history, nil for system time
+	Clock Clock
+
+	//Message ID of new message to each endpoint
+	msgIDs *MessageIDGenerator
+	//Random ID of this broker instance in heart beat response, client register again when it change
+	instance []byte
+
+	//Protect all maps below, CoAP handlers run concurrently on each request
+	lock sync.RWMutex
+	//map to store "client -> Topic filter List" for find subscription, client is subscriber ID
+	clientMapTopics clientMapStringList
+	//Trie to store "topic filter -> client List" for publish, filter could include wildcard
+	topicMapClients *topicTrie
+	//map to store "client -> observer" to send notification
+	clientMapObserver map[string]*observer
+	//map to store "address/message ID -> client" to match ACK and RST of notification
+	msgIDMapClient map[string]string
+	//Store all topic list and its latest value, value is binary such as CBOR
+	topicMapValue map[string][]byte
+	//Store link-format attributes (rt, ct, if...) of each topic for discovery
+	topicMapAttrs map[string]map[string]string
+	//Latest published values of each topic, only kept in memory
+	topicHistory map[string]*historyRing
+	//Last use and value expiry of each topic, only kept in memory
+	topicUsage map[string]*topicUsage
+	//Next time to check topic lifetime and value Max-Age, zero if nothing expire
+	nextExpiry time.Time
+	//nextExpiry is computed, false before first check
+	expiryScheduled bool
+
+	//Persist topics, values and subscriptions, all maps above are loaded from it
+	store Store
+
+	//Response of recent confirmable requests, replay to retransmitted request
+	dedup *dedupCache
+
+	//Protect blockTransfers, partial Block1 payload of publish by "address topic"
+	blockLock      sync.Mutex
+	blockTransfers map[string]*blockTransfer
+
+	//Protect conns and closing, track in-flight requests for graceful shutdown
+	serveLock sync.Mutex
+	conns     map[*net.UDPConn]struct{}
+	closing   bool
+	inFlight  sync.WaitGroup
 }
 
 //Create a new pubsub server using CoAP protocol
-//maxChannel: It is the subpub topic limitation size, suggest not lower than 1024 for basic usage
-func NewBroker(maxCapacity int) *Broker {
+//maxCapacity: It is the subpub topic limitation size, suggest not lower than 1024 for basic usage
+//store: Persist topics and subscriptions, nil for in-memory store. Broker load all records from it.
+func NewBroker(maxCapacity int, store Store) (*Broker, error) {
 	cSev := new(Broker)
 	cSev.Capacity = maxCapacity
-	cSev.clientMapTopics = make(map[*net.UDPAddr][]string, maxCapacity)
-	cSev.topicMapClients = make(map[string][]*net.UDPAddr, maxCapacity)
-	cSev.topicMapValue = make(map[string]string, maxCapacity)
+	cSev.AckTimeout = coap.ResponseTimeout
+	cSev.MaxRetransmit = coap.MaxRetransmit
+	cSev.BlockSize = DEFAULT_BLOCK_SIZE
+	cSev.ExchangeLifetime = exchangeLifetime
+	cSev.clientMapTopics = make(map[string][]string, maxCapacity)
+	cSev.topicMapClients = newTopicTrie()
+	cSev.clientMapObserver = make(map[string]*observer, maxCapacity)
+	cSev.msgIDMapClient = make(map[string]string, maxCapacity)
+	cSev.topicMapValue = make(map[string][]byte, maxCapacity)
+	cSev.topicMapAttrs = make(map[string]map[string]string, maxCapacity)
+	cSev.topicHistory = make(map[string]*historyRing)
+	cSev.topicUsage = make(map[string]*topicUsage, maxCapacity)
+	cSev.conns = make(map[*net.UDPConn]struct{})
+	cSev.blockTransfers = make(map[string]*blockTransfer)
+	cSev.dedup = newDedupCache()
+	cSev.msgIDs = NewMessageIDGenerator()
+	cSev.instance = NewToken()
+
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	cSev.store = store
+	if err := cSev.restore(); err != nil {
+		return nil, err
+	}
 
-	cSev.msgIndex = GetIPv4Int16() + GetLocalRandomInt()
-	log.Println("Init msgID=", cSev.msgIndex)
-	return cSev
+	return cSev, nil
 }
 
-func (c *Broker) getMsgID() uint16 {
-	c.msgIndex = c.msgIndex + 1
-	return c.msgIndex
+//Load all topics and subscriptions from store
+func (c *Broker) restore() error {
+	topics, subs, err := c.store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range topics {
+		c.topicMapValue[t.Topic] = t.Value
+		if t.Attrs != nil {
+			c.topicMapAttrs[t.Topic] = t.Attrs
+		}
+		//Lifetime start from first check, Clock may be set after restore
+		c.topicUsage[t.Topic] = &topicUsage{}
+	}
+	for _, sub := range subs {
+		addr, err := net.ResolveUDPAddr("udp", sub.Address)
+		if err != nil {
+			log.Println("Skip subscription with invalid address:", sub.Address, err)
+			continue
+		}
+		//Continue after reserved sequence number, observer drop older one as stale
+		obs := c.linkSubscription(sub.Topic, SubscriberID(addr, sub.Token), addr, sub.Token)
+		if newerSeq(obs.seq, sub.Seq) {
+			obs.seq, obs.reserved = sub.Seq, sub.Seq
+		}
+	}
+	log.Println("Restore", len(topics), "topics and", len(subs), "subscriptions from store")
+	return nil
+}
+
+//Message ID for new message to endpoint, NON response and notification
+func (c *Broker) getMsgID(a *net.UDPAddr) uint16 {
+	return c.msgIDs.NextWithin(a.String(), c.ExchangeLifetime)
 }
 
-func (c *Broker) removeSubscription(topic string, client *net.UDPAddr) coap.COAPCode {
+func (c *Broker) removeSubscription(topic string, client string) coap.COAPCode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	res := coap.Deleted
-	if _, exist := c.topicMapValue[topic]; !exist {
+	if !ContainString(c.clientMapTopics[client], topic) {
 		return coap.NotFound
 	}
+	c.unlinkSubscription(topic, client)
+	return res
+}
 
-	removeIndexT2C := -1
-	if val, exist := c.topicMapClients[topic]; exist {
-		for k, v := range val {
-			if v == client {
-				removeIndexT2C = k
-			}
-		}
-		if removeIndexT2C != -1 {
-			sliceClients := c.topicMapClients[topic]
-			if len(sliceClients) > 1 {
-				c.topicMapClients[topic] = append(sliceClients[:removeIndexT2C], sliceClients[removeIndexT2C+1:]...)
-			} else {
-				delete(c.topicMapClients, topic)
-			}
+//Remove the subscription from both trie and map, caller need hold the lock
+func (c *Broker) unlinkSubscription(topic string, client string) {
+	c.topicMapClients.remove(topic, client)
+	if obs, exist := c.clientMapObserver[client]; exist {
+		sub := SubscriptionRecord{Topic: topic, Address: obs.addr.String(), Token: obs.token}
+		if err := c.store.RemoveSubscription(sub); err != nil {
+			log.Println("Store remove subscription failed:", err)
 		}
 	}
 
-	removeIndexC2T := -1
-	if val, exist := c.clientMapTopics[client]; exist {
-		for k, v := range val {
-			if v == topic {
-				removeIndexC2T = k
-			}
-		}
-		if removeIndexC2T != -1 {
-			sliceTopics := c.clientMapTopics[client]
-			if len(sliceTopics) > 1 {
-				c.clientMapTopics[client] = append(sliceTopics[:removeIndexC2T], sliceTopics[removeIndexC2T+1:]...)
-			} else {
-				delete(c.clientMapTopics, client)
-			}
-		}
+	c.clientMapTopics[client] = RemoveStringFromSlice(c.clientMapTopics[client], topic)
+	if len(c.clientMapTopics[client]) == 0 {
+		delete(c.clientMapTopics, client)
+		c.dropObserver(client)
 	}
-	return res
 }
 
-//Create new topic in coapmq broker
-func (c *Broker) createTopic(topic string) coap.COAPCode {
+//Create new topic in coapmq broker, child topic "a/b" could only create under exist parent "a"
+//attrs are link-format attributes of topic, such as "ct" for its Content-Format
+func (c *Broker) createTopic(topic string, attrs map[string]string) coap.COAPCode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	res := coap.Created
+	if !ValidTopic(topic) {
+		log.Println("Create topic failed, invalid topic:", topic)
+		return coap.BadRequest
+	}
 	if _, exist := c.topicMapValue[topic]; exist {
 		res = coap.Forbidden
 		log.Println("Create topic failed, topic exist.")
 		return res
 	}
+	if res := c.checkTopicQuota(); res != coap.Created {
+		log.Println("Create topic failed, reach topic limit:", c.Capacity)
+		return res
+	}
+	if parent := ParentTopic(topic); parent != "" {
+		if _, exist := c.topicMapValue[parent]; !exist {
+			log.Println("Create topic failed, parent topic not exist:", parent)
+			return coap.NotFound
+		}
+	}
 
-	c.topicMapValue[topic] = "" //default value for creation
+	if err := c.store.CreateTopic(topic, attrs); err != nil {
+		log.Println("Store create topic failed:", err)
+		return coap.InternalServerError
+	}
+	c.topicMapValue[topic] = nil //default value for creation
+	if len(attrs) > 0 {
+		c.topicMapAttrs[topic] = attrs
+	}
+	c.addTopicUsage(topic, c.now())
 	return res
 }
 
-//Remove new topic in coapmq broker, will remove all subscriptions on this topic
+//Get topic attributes from link-format payload of create, such as "<topic1>;ct=60"
+//Only attributes in TOPIC_ATTRS are kept, "ct", "sz" and "lt" must be number.
+func topicAttrs(cmd *Cmd) (map[string]string, coap.COAPCode) {
+	if len(cmd.Payload) > 0 && cmd.ContentFormat != CONTENT_FORMAT_NONE && cmd.ContentFormat != int(coap.AppLinkFormat) {
+		return nil, coap.UnsupportedMediaType
+	}
+
+	var attrs map[string]string
+	for _, name := range TOPIC_ATTRS {
+		v, exist := cmd.Attrs[name]
+		if !exist {
+			continue
+		}
+		if name == "ct" || name == "sz" || name == TOPIC_LIFETIME_ATTR {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 || (name == "ct" && n > 0xffff) {
+				return nil, coap.BadRequest
+			}
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[name] = v
+	}
+	return attrs, coap.Created
+}
+
+//Content-Format of topic from its "ct" attribute, caller need hold the lock
+func (c *Broker) topicFormat(topic string) int {
+	if ct, err := strconv.Atoi(c.topicMapAttrs[topic]["ct"]); err == nil {
+		return ct
+	}
+	return CONTENT_FORMAT_NONE
+}
+
+//Check if format is acceptable for topic, CONTENT_FORMAT_NONE on any side is always acceptable
+func matchFormat(topicFormat int, format int) bool {
+	return topicFormat == CONTENT_FORMAT_NONE || format == CONTENT_FORMAT_NONE || topicFormat == format
+}
+
+//Remove new topic in coapmq broker, will remove all child topics and all subscriptions on them
 func (c *Broker) removeTopic(topic string) coap.COAPCode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	res := coap.Deleted
 
 	if _, exist := c.topicMapValue[topic]; !exist {
@@ -107,156 +282,543 @@ func (c *Broker) removeTopic(topic string) coap.COAPCode {
 		log.Println("Remove topic failed, topic not exist.")
 		return res
 	}
+	c.removeTopicLocked(topic)
+	return res
+}
+
+//Remove topic with all child topics and subscriptions on them, caller need hold the lock
+func (c *Broker) removeTopicLocked(topic string) {
+	for t := range c.topicMapValue {
+		if t != topic && !strings.HasPrefix(t, topic+"/") {
+			continue
+		}
 
-	//check if any client alreadt submit this topic
-	if clients, exist := c.topicMapClients[topic]; exist {
-		for _, client := range clients {
-			c.clientMapTopics[client] = RemoveStringFromSlice(c.clientMapTopics[client], topic)
+		//check if any client alreadt submit this topic, wildcard subscription is kept
+		for _, client := range c.topicMapClients.subscribers(t) {
+			c.unlinkSubscription(t, client)
+		}
+		if err := c.store.RemoveTopic(t); err != nil {
+			log.Println("Store remove topic failed:", err)
+		}
+		delete(c.topicMapValue, t)
+		delete(c.topicMapAttrs, t)
+		delete(c.topicHistory, t)
+		delete(c.topicUsage, t)
+	}
+	//Parent kept by this topic may expire now
+	for p := ParentTopic(topic); p != ""; p = ParentTopic(p) {
+		if d, ok := c.topicDeadline(p); ok {
+			c.scheduleExpiry(d)
 		}
 	}
-	delete(c.topicMapValue, topic)
-	return res
 }
 
-func (c *Broker) addSubscription(topic string, client *net.UDPAddr) coap.COAPCode {
-	res := coap.Created
+//Add subscription for client on topic, subscribe again with same client is no-op
+//Topic could be a filter with wildcard such as "sensors/+/temperature" or "sensors/#"
+//Return current value, its Content-Format and Observe sequence number for registration response.
+func (c *Broker) addSubscription(topic string, client string, addr *net.UDPAddr, token []byte, accept int) ([]byte, int, uint32, coap.COAPCode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if _, exist := c.topicMapValue[topic]; !exist {
-		return coap.NotFound
+	res := coap.Content
+
+	if !ValidTopicFilter(topic) {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.BadRequest
+	}
+	value, exist := c.topicMapValue[topic]
+	if !exist && !IsWildcardFilter(topic) {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.NotFound
+	}
+	format := c.topicFormat(topic)
+	if !matchFormat(format, accept) {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.NotAcceptable
 	}
 
-	topicFound := false
-	if val, exist := c.topicMapClients[topic]; exist {
-		for _, v := range val {
-			if v == client {
-				topicFound = true
-			}
+	//New observer reserve sequence numbers with its first subscription
+	reserved := uint32(observeSeqReserve)
+	old, observed := c.clientMapObserver[client]
+	if observed {
+		reserved = old.reserved
+	}
+	if !ContainString(c.clientMapTopics[client], topic) {
+		if res := c.checkSubscriptionQuota(topic, addr); res != coap.Content {
+			log.Println("Subscribe failed, reach subscription limit:", addr, topic)
+			return nil, CONTENT_FORMAT_NONE, 0, res
+		}
+		sub := SubscriptionRecord{Topic: topic, Address: addr.String(), Token: token, Seq: reserved}
+		if err := c.store.AddSubscription(sub); err != nil {
+			log.Println("Store add subscription failed:", err)
+			return nil, CONTENT_FORMAT_NONE, 0, coap.InternalServerError
 		}
 	}
-	if topicFound == false {
-		res = coap.NotFound
-		c.topicMapClients[topic] = append(c.topicMapClients[topic], client)
+	obs := c.linkSubscription(topic, client, addr, token)
+	if !observed {
+		obs.reserved = reserved
 	}
+	c.touchTopic(topic, c.now())
+	return value, format, c.nextSeq(obs), res
+}
 
-	clientFound := false
-	if val, exist := c.clientMapTopics[client]; exist {
-		for _, v := range val {
-			if v == topic {
-				clientFound = true
-			}
+//Add the subscription into both trie and map, caller need hold the lock
+func (c *Broker) linkSubscription(topic string, client string, addr *net.UDPAddr, token []byte) *observer {
+	c.topicMapClients.add(topic, client)
+	if !ContainString(c.clientMapTopics[client], topic) {
+		c.clientMapTopics[client] = append(c.clientMapTopics[client], topic)
+	}
+	obs, exist := c.clientMapObserver[client]
+	if !exist {
+		obs = &observer{id: client, token: token, pending: make(map[uint16]*pendingNotification)}
+		c.clientMapObserver[client] = obs
+	}
+	obs.addr = addr
+	return obs
+}
+
+//Discover topics match all query filter, return link-format list
+func (c *Broker) discoverTopics(query []string) ([]byte, coap.COAPCode) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return []byte(EncodeLinkFormat(filterLinks(c.topicLinks(), query))), coap.Content
+}
+
+//Resource discovery on /.well-known/core, list pub/sub function set and all topics
+func (c *Broker) wellKnownCore(query []string) ([]byte, coap.COAPCode) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	root := Link{URI: "/" + PUBSUB_PATH, Params: map[string]string{
+		"rt": PUBSUB_RT,
+		"ct": "40", //application/link-format
+	}}
+	links := append([]Link{root}, c.topicLinks()...)
+	return []byte(EncodeLinkFormat(filterLinks(links, query))), coap.Content
+}
+
+//Build link of all topics sorted by name, caller need hold the lock
+func (c *Broker) topicLinks() []Link {
+	var topics []string
+	for topic := range c.topicMapValue {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var links []Link
+	for _, topic := range topics {
+		link := Link{URI: "/" + PUBSUB_PATH + "/" + topic, Params: map[string]string{"obs": ""}}
+		for k, v := range c.topicMapAttrs[topic] {
+			link.Params[k] = v
 		}
+		links = append(links, link)
 	}
+	return links
+}
 
-	if clientFound == false {
-		c.clientMapTopics[client] = append(c.clientMapTopics[client], topic)
+func filterLinks(links []Link, query []string) []Link {
+	var ret []Link
+	for _, link := range links {
+		if link.Match(query) {
+			ret = append(ret, link)
+		}
 	}
-	return res
+	return ret
 }
 
-func (c *Broker) readTopic(topic string) (string, coap.COAPCode) {
+//Read value of topic, its Content-Format and remaining Max-Age, return 4.06 if accept not match topic format
+//Value expired by Max-Age is empty as topic without value, or 4.04 if ExpiredValueNotFound.
+func (c *Broker) readTopic(topic string, accept int) ([]byte, int, time.Duration, coap.COAPCode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	res := coap.Content
 
-	var retValue string
-	if value, exist := c.topicMapValue[topic]; !exist {
-		res = coap.NotFound
-		retValue = ""
-	} else {
-		retValue = value
+	value, exist := c.topicMapValue[topic]
+	if !exist {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.NotFound
+	}
+	format := c.topicFormat(topic)
+	if !matchFormat(format, accept) {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.NotAcceptable
+	}
+	now := c.now()
+	c.touchTopic(topic, now)
+	if u := c.topicUsage[topic]; u != nil && u.valueExpired && c.ExpiredValueNotFound {
+		return nil, CONTENT_FORMAT_NONE, 0, coap.NotFound
 	}
 
 	log.Println("read finished")
-	return retValue, res
+	return value, format, c.valueMaxAge(topic, now), res
 }
 
-func (c *Broker) publish(l *net.UDPConn, topic string, value string) coap.COAPCode {
+//Publish value on topic, return 4.15 if format not match topic format
+//Value is cleared after maxAge, 0 for never expire.
+func (c *Broker) publish(l *net.UDPConn, topic string, value []byte, format int, maxAge time.Duration) coap.COAPCode {
 	res := coap.Changed
+	if res := c.checkPayloadQuota(value); res != coap.Changed {
+		log.Println("Publish failed, payload too large:", len(value))
+		return res
+	}
+
+	c.lock.Lock()
 	if _, exist := c.topicMapValue[topic]; !exist {
+		c.lock.Unlock()
 		return coap.NotFound
 	}
-
-	if clients, exist := c.topicMapClients[topic]; exist {
-		for _, client := range clients {
-			c.publishMsg(l, client, topic, value)
-			log.Println("topic->", topic, " PUB to ", client, " msg=", value)
-		}
+	if !matchFormat(c.topicFormat(topic), format) {
+		c.lock.Unlock()
+		log.Println("Publish failed, Content-Format not match topic:", format)
+		return coap.UnsupportedMediaType
 	}
-
+	if err := c.store.SetValue(topic, value); err != nil {
+		c.lock.Unlock()
+		log.Println("Store set value failed:", err)
+		return coap.InternalServerError
+	}
+	//Copy value, request buffer is not owned by broker
+	value = append([]byte(nil), value...)
 	c.topicMapValue[topic] = value
+	now := c.now()
+	c.touchTopic(topic, now)
+	c.setValueMaxAge(topic, now, maxAge)
+	c.addHistory(topic, value, now)
+	//Fan-out run without holding the lock
+	clients := c.topicMapClients.match(topic)
+	format = c.topicFormat(topic)
+	c.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client string) {
+			defer wg.Done()
+			c.notify(l, client, topic, value, format, maxAge)
+			log.Println("topic->", topic, " PUB to ", client, " len=", len(value))
+		}(client)
+	}
+	wg.Wait()
 	return res
 }
 
 func (c *Broker) handleCoAPMessage(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+	//Topic and value expired before this request are removed first
+	c.expireTopics(l)
+
 	cmd, err := MessageDecode(m)
 	if err != nil {
 		log.Println("Message decode err:", err)
-		m.Code = coap.BadRequest
-		return m
+		return c.response(a, coap.BadRequest, nil, m)
 	}
 
 	log.Println("cmd=", cmd)
 
 	res := coap.BadRequest
-	retValue := ""
+	var retValue []byte
 	reqCmd := ""
+	var seq uint32
+	var maxAge time.Duration
+	format := CONTENT_FORMAT_NONE
 
 	switch cmd.Type {
 	case CMD_SUBSCRIBE:
-		res = c.addSubscription(cmd.Topic, a)
+		retValue, format, seq, res = c.addSubscription(cmd.Topic, SubscriberID(a, m.Token), a, m.Token, cmd.Accept)
 		reqCmd = "Subscription:" + cmd.Topic
 	case CMD_UNSUBSCRIBE:
-		res = c.removeSubscription(cmd.Topic, a)
+		res = c.removeSubscription(cmd.Topic, SubscriberID(a, m.Token))
 		reqCmd = "Reqmove Sub topic:" + cmd.Topic
 	case CMD_PUBLISH:
-		res = c.publish(l, cmd.Topic, string(m.Payload))
-		reqCmd = "Publish:" + cmd.Topic + " data:" + cmd.Msg
+		payload, rv := c.receiveBlock1(a, m, cmd.Topic)
+		if rv != nil {
+			//Wait more block or block error
+			return rv
+		}
+		res = c.publish(l, cmd.Topic, payload, cmd.ContentFormat, cmd.MaxAge)
+		reqCmd = "Publish:" + cmd.Topic + " len:" + strconv.Itoa(len(cmd.Payload))
 	case CMD_HEARTBEAT:
-		m.Code = coap.Content
+		res = coap.Content
+		retValue = c.instance
 		reqCmd = "Heart Beat"
 	case CMD_CREATE:
-		res = c.createTopic(cmd.Topic)
+		var attrs map[string]string
+		if attrs, res = topicAttrs(cmd); res == coap.Created {
+			res = c.createTopic(cmd.Topic, attrs)
+		}
 		reqCmd = "Create topic:" + cmd.Topic
 	case CMD_READ:
-		retValue, res = c.readTopic(cmd.Topic)
+		if isHistoryQuery(cmd.Query) {
+			retValue, format, res = c.readHistoryQuery(cmd.Topic, cmd.Query, cmd.Accept)
+		} else {
+			retValue, format, maxAge, res = c.readTopic(cmd.Topic, cmd.Accept)
+		}
 		reqCmd = "Read topic:" + cmd.Topic
 	case CMD_REMOVE:
 		res = c.removeTopic(cmd.Topic)
 		reqCmd = "Remove topic:" + cmd.Topic
+	case CMD_DISCOVER:
+		retValue, res = c.discoverTopics(cmd.Query)
+		reqCmd = "Discover topic:" + strings.Join(cmd.Query, "&")
+	case CMD_WELLKNOWN_CORE:
+		retValue, res = c.wellKnownCore(cmd.Query)
+		reqCmd = "Well-known core:" + strings.Join(cmd.Query, "&")
 	default:
 		reqCmd = "Invalid Command:"
 	}
 
 	log.Println("Got cmd=", reqCmd, " from:", a)
-	log.Println("Current all topics:", c.topicMapValue)
-	for k, v := range c.topicMapClients {
-		log.Println("Topic=", k, " sub by client=>", v)
-	}
+	c.logState()
 
 	//Prepare response message
-	return c.response(res, retValue, m)
+	rv := c.response(a, res, retValue, m)
+	if format != CONTENT_FORMAT_NONE {
+		rv.SetOption(coap.ContentFormat, format)
+	}
+	if maxAge > 0 {
+		rv.SetOption(coap.MaxAge, maxAgeSeconds(maxAge))
+	}
+	//Large value is sent by Block2, client get remain blocks by GET
+	if (cmd.Type == CMD_READ || cmd.Type == CMD_SUBSCRIBE) && res == coap.Content {
+		if !setBlock2(rv, retValue, m, validBlockSize(c.BlockSize)) {
+			return c.response(a, coap.BadOption, nil, m)
+		}
+	}
+	switch cmd.Type {
+	case CMD_CREATE:
+		//Location of new topic (draft-ietf-core-coap-pubsub CREATE)
+		if res == coap.Created {
+			for _, seg := range append([]string{PUBSUB_PATH}, SplitTopic(cmd.Topic)...) {
+				rv.AddOption(coap.LocationPath, seg)
+			}
+		}
+	case CMD_DISCOVER, CMD_WELLKNOWN_CORE:
+		rv.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+	case CMD_SUBSCRIBE:
+		if res == coap.Content {
+			rv.SetOption(coap.Observe, seq)
+		}
+	case CMD_PUBLISH:
+		//Last block of Block1 transfer
+		if block, exist := BlockOption(m, BLOCK1); exist {
+			rv.SetOption(BLOCK1, Block{Num: block.Num, Size: block.Size}.Value())
+		}
+		//Tell client the maximal payload size (RFC 7252 section 5.10.9)
+		if res == coap.RequestEntityTooLarge {
+			rv.SetOption(coap.Size1, uint32(c.MaxPayloadSize))
+		}
+	}
+	return rv
 }
 
-//Start to listen udp port and serve request, until faltal eror occur
-func (c *Broker) ListenAndServe(udpPort string) {
-	log.Fatal(coap.ListenAndServe("udp", udpPort,
-		coap.FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
-			return c.handleCoAPMessage(l, a, m)
-		})))
+func (c *Broker) logState() {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	log.Println("Current all topics:", c.topicMapValue)
+	c.topicMapClients.walk(func(filter string, clients []string) {
+		log.Println("Topic=", filter, " sub by client=>", clients)
+	})
 }
 
-func (c *Broker) response(res coap.COAPCode, data string, m *coap.Message) *coap.Message {
-	m.Type = coap.Acknowledgement
-	m.Code = res
-	if data != "" {
-		m.Payload = []byte(data)
+//ServeCOAP implement coap.Handler, it is safe to be called from multiple goroutines
+func (c *Broker) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+	//ACK and RST from observer for notification, no response
+	if m.Type == coap.Acknowledgement || m.Type == coap.Reset {
+		c.handleObserverReply(a, m)
+		return nil
+	}
+
+	//Retransmitted confirmable request only get the same response
+	if m.Type == coap.Confirmable {
+		key := exchangeKey(a, m.MessageID)
+		if rv, dup := c.dedup.begin(key, m.Token, c.ExchangeLifetime); dup {
+			log.Println("Duplicate request from:", a, " msgID=", m.MessageID)
+			return rv
+		}
+		rv := c.handleCoAPMessage(l, a, m)
+		c.dedup.finish(key, m.Token, rv)
+		return rv
 	}
-	return m
+	return c.handleCoAPMessage(l, a, m)
 }
 
-func (c *Broker) publishMsg(l *net.UDPConn, a *net.UDPAddr, topic string, msg string) {
-	m := EncodeMessage(c.getMsgID(), CMD_PUBLISH, msg, topic)
-	err := coap.Transmit(l, a, *m)
+//Start to listen udp port and serve request, until Shutdown or error occur
+func (c *Broker) ListenAndServe(udpPort string) error {
+	addr, err := net.ResolveUDPAddr("udp", udpPort)
 	if err != nil {
-		log.Printf("Error on transmitter, stopping: %v", err)
-		return
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(context.Background(), conn)
+}
+
+//Serve request on conn until ctx is done or Shutdown, conn is closed by Shutdown
+//Return ctx.Err() if ctx is done, ErrBrokerClosed after Shutdown.
+func (c *Broker) Serve(ctx context.Context, conn *net.UDPConn) error {
+	c.serveLock.Lock()
+	if c.closing {
+		c.serveLock.Unlock()
+		return ErrBrokerClosed
+	}
+	c.conns[conn] = struct{}{}
+	c.serveLock.Unlock()
+
+	defer func() {
+		c.serveLock.Lock()
+		delete(c.conns, conn)
+		c.serveLock.Unlock()
+	}()
+
+	//Unblock read when ctx is done, and check topic lifetime when there is no request
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.SetReadDeadline(time.Now())
+				return
+			case <-ticker.C:
+				c.expireTopics(conn)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if c.isClosing() {
+				return ErrBrokerClosed
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		m, err := parseMessage(data)
+		if err != nil {
+			log.Println("Message parse err:", err, " from:", addr)
+			continue
+		}
+
+		if !c.beginRequest() {
+			//Shutting down, only handle ACK/RST for draining notifications
+			if rv := c.serveClosing(addr, m); rv != nil {
+				coap.Transmit(conn, addr, *rv)
+			}
+			continue
+		}
+		go func() {
+			defer c.inFlight.Done()
+			if rv := c.ServeCOAP(conn, addr, m); rv != nil {
+				if err := coap.Transmit(conn, addr, *rv); err != nil {
+					log.Println("Error on transmit response to", addr, " err:", err)
+				}
+			}
+		}()
+	}
+}
+
+func (c *Broker) isClosing() bool {
+	c.serveLock.Lock()
+	defer c.serveLock.Unlock()
+	return c.closing
+}
+
+//Track in-flight request, return false if broker is shutting down
+func (c *Broker) beginRequest() bool {
+	c.serveLock.Lock()
+	defer c.serveLock.Unlock()
+
+	if c.closing {
+		return false
+	}
+	c.inFlight.Add(1)
+	return true
+}
+
+//Handle message when shutting down, reply 5.03 for any request
+func (c *Broker) serveClosing(a *net.UDPAddr, m *coap.Message) *coap.Message {
+	if m.Type == coap.Acknowledgement || m.Type == coap.Reset {
+		c.handleObserverReply(a, m)
+		return nil
+	}
+	return c.response(a, coap.ServiceUnavailable, nil, m)
+}
+
+//Gracefully shutdown broker, it stop accept new request and wait in-flight requests and notifications done
+//Then notify observers with 5.03 if NotifyOnShutdown is set, and close all serving conns.
+//If ctx is done before draining, conns are still closed and ctx.Err() is returned.
+func (c *Broker) Shutdown(ctx context.Context) error {
+	c.serveLock.Lock()
+	c.closing = true
+	c.serveLock.Unlock()
+
+	err := c.drain(ctx)
+
+	if c.NotifyOnShutdown {
+		c.notifyShutdown()
+	}
+
+	c.serveLock.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.serveLock.Unlock()
+
+	c.stopRetransmit()
+	return err
+}
+
+//Wait in-flight requests, then wait all confirmable notifications acknowledged or evicted
+func (c *Broker) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for c.pendingNotifications() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+//Response piggybacked in ACK, or in NON with new message ID if request is NON
+func (c *Broker) response(a *net.UDPAddr, res coap.COAPCode, data []byte, m *coap.Message) *coap.Message {
+	rv := new(coap.Message)
+	rv.Type = coap.Acknowledgement
+	rv.MessageID = m.MessageID
+	if m.Type == coap.NonConfirmable {
+		rv.Type = coap.NonConfirmable
+		rv.MessageID = c.getMsgID(a)
+	}
+	rv.Code = res
+	rv.Token = m.Token
+	if len(data) > 0 {
+		rv.Payload = data
 	}
+	return rv
 }
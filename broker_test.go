@@ -0,0 +1,814 @@
+package coapmq_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func newBroker(t testing.TB) *Broker {
+	broker, err := NewBroker(1024, nil)
+	if err != nil {
+		t.Fatal("Create broker failed:", err)
+	}
+	return broker
+}
+
+//Start a broker on an ephemeral loopback port
+func startBroker(t testing.TB) (*Broker, *net.UDPConn) {
+	broker := newBroker(t)
+	return broker, serveBroker(t, broker)
+}
+
+//Serve a configured broker on an ephemeral loopback port
+func serveBroker(t testing.TB, broker *Broker) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	go broker.Serve(context.Background(), conn)
+	return conn
+}
+
+//Marshal and parse message as it go through network, option values are decoded to wire type
+func wireMessage(t testing.TB, m *coap.Message) *coap.Message {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal("Marshal message failed:", err)
+	}
+	rv, err := coap.ParseMessage(data)
+	if err != nil {
+		t.Fatal("Parse message failed:", err)
+	}
+	return &rv
+}
+
+func sendCmd(t testing.TB, conn *coap.Conn, msgID uint16, cmd CMD_TYPE, topic string, msg string) *coap.Message {
+	rv, err := conn.Send(*EncodeMessage(msgID, cmd, msg, topic))
+	if err != nil {
+		t.Error("Send cmd failed:", err)
+		return nil
+	}
+	return rv
+}
+
+func TestBrokerConcurrentHandlers(t *testing.T) {
+	broker, conn := startBroker(t)
+	defer conn.Close()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("t%d", i%4)
+			for j := 0; j < 50; j++ {
+				for _, cmd := range []CMD_TYPE{CMD_CREATE, CMD_SUBSCRIBE, CMD_PUBLISH, CMD_READ, CMD_UNSUBSCRIBE, CMD_REMOVE} {
+					m := EncodeMessage(uint16(i*1000+j), cmd, "v", topic)
+					broker.ServeCOAP(conn, client, m)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBrokerStressPubSub(t *testing.T) {
+	const (
+		topics      = 4
+		subscribers = 16
+		publishers  = 8
+		publishes   = 20
+	)
+
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	admin, err := coap.Dial("udp", addr)
+	if err != nil {
+		t.Fatal("Dial failed:", err)
+	}
+	for i := 0; i < topics; i++ {
+		rv := sendCmd(t, admin, uint16(i), CMD_CREATE, fmt.Sprintf("t%d", i), "")
+		if rv == nil || rv.Code != coap.Created {
+			t.Fatal("Create topic failed:", rv)
+		}
+	}
+
+	var subWg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		sub, err := coap.Dial("udp", addr)
+		if err != nil {
+			t.Fatal("Dial failed:", err)
+		}
+		sendCmd(t, sub, uint16(100+i), CMD_SUBSCRIBE, fmt.Sprintf("t%d", i%topics), "")
+		subWg.Add(1)
+		go func() {
+			defer subWg.Done()
+			//Drain notifications until publishers stop and read timeout
+			for {
+				if _, err := sub.Receive(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var pubWg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		pub, err := coap.Dial("udp", addr)
+		if err != nil {
+			t.Fatal("Dial failed:", err)
+		}
+		pubWg.Add(1)
+		go func(i int) {
+			defer pubWg.Done()
+			for j := 0; j < publishes; j++ {
+				topic := fmt.Sprintf("t%d", (i+j)%topics)
+				rv := sendCmd(t, pub, uint16(1000+i*publishes+j), CMD_PUBLISH, topic, fmt.Sprintf("%d-%d", i, j))
+				if rv != nil && rv.Code != coap.Changed {
+					t.Error("Publish failed, code:", rv.Code)
+				}
+			}
+		}(i)
+	}
+	pubWg.Wait()
+	subWg.Wait()
+
+	for i := 0; i < topics; i++ {
+		rv := sendCmd(t, admin, uint16(50+i), CMD_READ, fmt.Sprintf("t%d", i), "")
+		if rv == nil || rv.Code != coap.Content || len(rv.Payload) == 0 {
+			t.Error("Read topic after publish failed:", rv)
+		}
+	}
+}
+
+func TestBrokerSubscribeIdempotent(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+
+	token := []byte{0xca, 0xfe}
+	for i := 0; i < 3; i++ {
+		m := EncodeMessage(uint16(10+i), CMD_SUBSCRIBE, "", "t1")
+		m.Token = token
+		if rv, err := sub.Send(*m); err != nil || rv.Code != coap.Content {
+			t.Fatal("Subscribe failed:", rv, err)
+		}
+	}
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	if rv, err := sub.Receive(); err != nil || string(rv.Payload) != "v1" {
+		t.Fatal("Notification not received:", rv, err)
+	}
+	if rv, err := sub.Receive(); err == nil {
+		t.Error("Duplicate notification received:", rv)
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+
+	token := []byte{0xbe, 0xef}
+	m := EncodeMessage(10, CMD_SUBSCRIBE, "", "t1")
+	m.Token = token
+	sub.Send(*m)
+
+	//Other token from same endpoint is another subscriber
+	m = EncodeMessage(11, CMD_UNSUBSCRIBE, "", "t1")
+	m.Token = []byte{0x01}
+	if rv, err := sub.Send(*m); err != nil || rv.Code != coap.NotFound {
+		t.Error("Unsubscribe with unknown token should fail:", rv, err)
+	}
+
+	m = EncodeMessage(12, CMD_UNSUBSCRIBE, "", "t1")
+	m.Token = token
+	if rv, err := sub.Send(*m); err != nil || rv.Code != coap.Deleted {
+		t.Fatal("Unsubscribe failed:", rv, err)
+	}
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	if rv, err := sub.Receive(); err == nil {
+		t.Error("Notification received after unsubscribe:", rv)
+	}
+}
+
+func TestBrokerDiscover(t *testing.T) {
+	broker := newBroker(t)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	for k, topic := range []string{"t1", "t2", "x1"} {
+		broker.ServeCOAP(nil, client, EncodeMessage(uint16(10+k), CMD_CREATE, "", topic))
+	}
+
+	rv := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_DISCOVER, "", ""))
+	if rv.Code != coap.Content || string(rv.Payload) != "</ps/t1>;obs,</ps/t2>;obs,</ps/x1>;obs" {
+		t.Error("Discover all topics failed:", rv.Code, string(rv.Payload))
+	}
+	if rv.Option(coap.ContentFormat) != coap.AppLinkFormat {
+		t.Error("Discover response should be link-format")
+	}
+
+	rv = broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_DISCOVER, "", "href=/ps/t*"))
+	if rv.Code != coap.Content || string(rv.Payload) != "</ps/t1>;obs,</ps/t2>;obs" {
+		t.Error("Discover with filter failed:", rv.Code, string(rv.Payload))
+	}
+}
+
+func TestBrokerWellKnownCore(t *testing.T) {
+	broker := newBroker(t)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+
+	rv := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_WELLKNOWN_CORE, "", ""))
+	if rv.Code != coap.Content || string(rv.Payload) != `</ps>;ct=40;rt="core.ps",</ps/t1>;obs` {
+		t.Error("Well-known core failed:", rv.Code, string(rv.Payload))
+	}
+
+	rv = broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_WELLKNOWN_CORE, "", "rt=core.ps"))
+	if rv.Code != coap.Content || string(rv.Payload) != `</ps>;ct=40;rt="core.ps"` {
+		t.Error("Well-known core with filter failed:", rv.Code, string(rv.Payload))
+	}
+}
+
+func TestBrokerHierarchicalTopic(t *testing.T) {
+	broker := newBroker(t)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	var msgID uint16
+	serve := func(cmd CMD_TYPE, topic string, msg string) *coap.Message {
+		msgID++
+		return broker.ServeCOAP(nil, client, EncodeMessage(msgID, cmd, msg, topic))
+	}
+
+	if rv := serve(CMD_CREATE, "building1/floor2", ""); rv.Code != coap.NotFound {
+		t.Error("Create child without parent should fail:", rv.Code)
+	}
+	for _, topic := range []string{"building1", "building1/floor2", "building1/floor2/temp", "building2"} {
+		if rv := serve(CMD_CREATE, topic, ""); rv.Code != coap.Created {
+			t.Fatal("Create topic failed:", topic, rv.Code)
+		}
+	}
+
+	serve(CMD_PUBLISH, "building1/floor2/temp", "25")
+	if rv := serve(CMD_READ, "building1/floor2/temp", ""); rv.Code != coap.Content || string(rv.Payload) != "25" {
+		t.Error("Read child topic failed:", rv.Code, string(rv.Payload))
+	}
+
+	if rv := serve(CMD_REMOVE, "building1/floor2", ""); rv.Code != coap.Deleted {
+		t.Error("Remove topic failed:", rv.Code)
+	}
+	if rv := serve(CMD_READ, "building1/floor2/temp", ""); rv.Code != coap.NotFound {
+		t.Error("Child topic should be removed with parent:", rv.Code)
+	}
+	if rv := serve(CMD_READ, "building1", ""); rv.Code != coap.Content {
+		t.Error("Parent topic should be kept:", rv.Code)
+	}
+	if rv := serve(CMD_DISCOVER, "", ""); string(rv.Payload) != "</ps/building1>;obs,</ps/building2>;obs" {
+		t.Error("Discover after remove failed:", string(rv.Payload))
+	}
+}
+
+func TestBrokerWildcardSubscription(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	for k, topic := range []string{"sensors", "sensors/s1", "sensors/s1/temperature", "sensors/s1/humidity", "sensors/s2", "sensors/s2/temperature"} {
+		sendCmd(t, pub, uint16(10+k), CMD_CREATE, topic, "")
+	}
+
+	subscribe := func(filter string) *coap.Conn {
+		sub, _ := coap.Dial("udp", addr)
+		m := EncodeMessage(2, CMD_SUBSCRIBE, "", filter)
+		m.Token = []byte(filter[len(filter)-1:])
+		if rv, err := sub.Send(*m); err != nil || rv.Code != coap.Content {
+			t.Fatal("Subscribe failed:", filter, rv, err)
+		}
+		return sub
+	}
+	single := subscribe("sensors/+/temperature")
+	multi := subscribe("sensors/#")
+
+	//Notification Location-Path is the concrete topic
+	expect := func(sub *coap.Conn, topic string, value string) {
+		rv, err := sub.Receive()
+		if err != nil || locationPath(rv) != "ps/"+topic || string(rv.Payload) != value {
+			t.Error("Expect notification from", topic, "got:", rv, err)
+		}
+	}
+
+	sendCmd(t, pub, 3, CMD_PUBLISH, "sensors/s1/temperature", "21")
+	expect(single, "sensors/s1/temperature", "21")
+	expect(multi, "sensors/s1/temperature", "21")
+
+	sendCmd(t, pub, 4, CMD_PUBLISH, "sensors/s2/temperature", "22")
+	expect(single, "sensors/s2/temperature", "22")
+	expect(multi, "sensors/s2/temperature", "22")
+
+	sendCmd(t, pub, 5, CMD_PUBLISH, "sensors/s1/humidity", "50")
+	expect(multi, "sensors/s1/humidity", "50")
+
+	sendCmd(t, pub, 6, CMD_PUBLISH, "sensors", "on")
+	expect(multi, "sensors", "on")
+	if rv, err := single.Receive(); err == nil {
+		t.Error("Single level wildcard should not match:", locationPath(rv))
+	}
+
+	m := EncodeMessage(7, CMD_SUBSCRIBE, "", "sensors/#/temperature")
+	if rv, err := pub.Send(*m); err != nil || rv.Code != coap.BadRequest {
+		t.Error("Invalid filter should be rejected:", rv, err)
+	}
+}
+
+func locationPath(m *coap.Message) string {
+	var path []string
+	for _, seg := range m.Options(coap.LocationPath) {
+		path = append(path, seg.(string))
+	}
+	return strings.Join(path, "/")
+}
+
+//Interop with a plain RFC 7641 observer built on go-coap only
+func TestBrokerObserveInterop(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "temp", "")
+	sendCmd(t, pub, 2, CMD_PUBLISH, "temp", "20")
+
+	obs, _ := coap.Dial("udp", addr)
+	req := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.GET,
+		MessageID: 100,
+		Token:     []byte("obs1"),
+	}
+	req.SetPathString("/ps/temp")
+	req.SetOption(coap.Observe, 0)
+	rv, err := obs.Send(req)
+	if err != nil {
+		t.Fatal("Register observe failed:", err)
+	}
+	if rv.Type != coap.Acknowledgement || rv.MessageID != 100 || rv.Code != coap.Content ||
+		string(rv.Token) != "obs1" || string(rv.Payload) != "20" {
+		t.Fatal("Registration response failed:", rv)
+	}
+	lastSeq, ok := rv.Option(coap.Observe).(uint32)
+	if !ok {
+		t.Fatal("Registration response without Observe option:", rv)
+	}
+
+	for i, value := range []string{"21", "22", "23"} {
+		sendCmd(t, pub, uint16(3+i), CMD_PUBLISH, "temp", value)
+		rv, err := obs.Receive()
+		if err != nil {
+			t.Fatal("Notification not received:", err)
+		}
+		if rv.Code != coap.Content || string(rv.Token) != "obs1" || string(rv.Payload) != value {
+			t.Error("Notification not match registration:", rv)
+		}
+		seq, ok := rv.Option(coap.Observe).(uint32)
+		if !ok || seq <= lastSeq {
+			t.Error("Observe sequence not increased:", lastSeq, seq)
+		}
+		lastSeq = seq
+
+		if rv.IsConfirmable() {
+			obs.Send(coap.Message{Type: coap.Acknowledgement, MessageID: rv.MessageID})
+		}
+	}
+}
+
+func subscribeRaw(t *testing.T, addr string, topic string, token string) *coap.Conn {
+	sub, err := coap.Dial("udp", addr)
+	if err != nil {
+		t.Fatal("Dial failed:", err)
+	}
+	m := EncodeMessage(10, CMD_SUBSCRIBE, "", topic)
+	m.Token = []byte(token)
+	if rv, err := sub.Send(*m); err != nil || rv.Code != coap.Content {
+		t.Fatal("Subscribe failed:", rv, err)
+	}
+	return sub
+}
+
+func TestBrokerNotificationAck(t *testing.T) {
+	broker := newBroker(t)
+	broker.AckTimeout = 50 * time.Millisecond
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "ack")
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	rv, err := sub.Receive()
+	if err != nil || !rv.IsConfirmable() {
+		t.Fatal("Notification should be confirmable:", rv, err)
+	}
+	sub.Send(coap.Message{Type: coap.Acknowledgement, MessageID: rv.MessageID})
+
+	time.Sleep(300 * time.Millisecond)
+	states := broker.DeliveryStates()
+	if len(states) != 1 || states[0].Pending != 0 || states[0].Delivered != 1 || states[0].Retransmits != 0 || states[0].LastAck.IsZero() {
+		t.Error("Delivery state after ACK failed:", states)
+	}
+}
+
+func TestBrokerNotificationRetransmitAndEvict(t *testing.T) {
+	broker := newBroker(t)
+	broker.AckTimeout = 20 * time.Millisecond
+	broker.MaxRetransmit = 2
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "lost")
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	//Never ACK, expect first transmission and MaxRetransmit retransmissions with same message ID
+	first, err := sub.Receive()
+	if err != nil {
+		t.Fatal("Notification not received:", err)
+	}
+	if states := broker.DeliveryStates(); len(states) != 1 || states[0].Pending != 1 {
+		t.Error("Notification should be pending:", states)
+	}
+	for i := 0; i < 2; i++ {
+		rv, err := sub.Receive()
+		if err != nil || rv.MessageID != first.MessageID {
+			t.Fatal("Retransmission not received:", rv, err)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if states := broker.DeliveryStates(); len(states) != 0 {
+		t.Error("Observer should be evicted:", states)
+	}
+	sendCmd(t, pub, 3, CMD_PUBLISH, "t1", "v2")
+	if rv, err := sub.Receive(); err == nil {
+		t.Error("Evicted observer should not get notification:", rv)
+	}
+}
+
+func TestBrokerNotificationReplace(t *testing.T) {
+	broker := newBroker(t)
+	broker.AckTimeout = 200 * time.Millisecond
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "slow")
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	if rv, err := sub.Receive(); err != nil || string(rv.Payload) != "v1" {
+		t.Fatal("Notification not received:", rv, err)
+	}
+	//Not ACK v1, v2 replace it and only v2 is retransmitted
+	sendCmd(t, pub, 3, CMD_PUBLISH, "t1", "v2")
+	second, err := sub.Receive()
+	if err != nil || string(second.Payload) != "v2" {
+		t.Fatal("Newer notification not received:", second, err)
+	}
+	for i := 0; i < 2; i++ {
+		rv, err := sub.Receive()
+		if err != nil || rv.MessageID != second.MessageID || string(rv.Payload) != "v2" {
+			t.Fatal("Only newer notification should be retransmitted:", rv, err)
+		}
+	}
+	if states := broker.DeliveryStates(); len(states) != 1 || states[0].Pending != 1 {
+		t.Error("Only one notification should be pending:", states)
+	}
+}
+
+func TestBrokerNotificationReset(t *testing.T) {
+	broker, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "rst")
+
+	sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	rv, err := sub.Receive()
+	if err != nil {
+		t.Fatal("Notification not received:", err)
+	}
+	sub.Send(coap.Message{Type: coap.Reset, MessageID: rv.MessageID})
+
+	time.Sleep(100 * time.Millisecond)
+	if states := broker.DeliveryStates(); len(states) != 0 {
+		t.Error("Observer should be evicted by RST:", states)
+	}
+}
+
+func TestShutdownRestart(t *testing.T) {
+	var addr *net.UDPAddr
+	for i := 0; i < 20; i++ {
+		broker := newBroker(t)
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			t.Fatal("Listen failed on round", i, ":", err)
+		}
+		if addr == nil {
+			//Reuse same port on later rounds, it must be released by shutdown
+			addr = conn.LocalAddr().(*net.UDPAddr)
+		}
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- broker.Serve(context.Background(), conn) }()
+
+		client, err := coap.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal("Dial failed:", err)
+		}
+		if rv := sendCmd(t, client, uint16(i), CMD_CREATE, "t1", ""); rv == nil || rv.Code != coap.Created {
+			t.Fatal("Create topic failed on round", i)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := broker.Shutdown(ctx); err != nil {
+			t.Error("Shutdown failed:", err)
+		}
+		cancel()
+
+		select {
+		case err := <-errCh:
+			if err != ErrBrokerClosed {
+				t.Error("Serve should return ErrBrokerClosed, got:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Serve not return after shutdown")
+		}
+		if err := broker.Serve(context.Background(), conn); err != ErrBrokerClosed {
+			t.Error("Serve after shutdown should return ErrBrokerClosed, got:", err)
+		}
+	}
+}
+
+func TestServeContextCancel(t *testing.T) {
+	broker := newBroker(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- broker.Serve(ctx, conn) }()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Error("Serve should return context.Canceled, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve not return after cancel")
+	}
+}
+
+func TestShutdownNotifyObservers(t *testing.T) {
+	broker := newBroker(t)
+	broker.NotifyOnShutdown = true
+	conn := serveBroker(t, broker)
+
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "tk1")
+
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Error("Shutdown failed:", err)
+	}
+
+	rv, err := sub.Receive()
+	if err != nil {
+		t.Fatal("No shutdown notification:", err)
+	}
+	if rv.Code != coap.ServiceUnavailable || string(rv.Token) != "tk1" {
+		t.Error("Expect 5.03 with token tk1, got:", rv.Code, string(rv.Token))
+	}
+}
+
+func TestShutdownWaitNotification(t *testing.T) {
+	broker := newBroker(t)
+	broker.AckTimeout = time.Second
+	conn := serveBroker(t, broker)
+
+	//Subscriber never ACK, notification keep pending
+	obs, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer obs.Close()
+	broker.ServeCOAP(conn, obs.LocalAddr().(*net.UDPAddr), wireMessage(t, EncodeMessage(1, CMD_CREATE, "", "t1")))
+	sub := EncodeMessage(2, CMD_SUBSCRIBE, "", "t1")
+	sub.Token = []byte("tk1")
+	broker.ServeCOAP(conn, obs.LocalAddr().(*net.UDPAddr), wireMessage(t, sub))
+	broker.ServeCOAP(conn, obs.LocalAddr().(*net.UDPAddr), wireMessage(t, EncodeMessage(3, CMD_PUBLISH, "v1", "t1")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := broker.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Shutdown should wait unacknowledged notification, got:", err)
+	}
+}
+
+func TestBrokerContentFormat(t *testing.T) {
+	broker := newBroker(t)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	var msgID uint16
+	serve := func(cmd *Cmd) *coap.Message {
+		msgID++
+		return broker.ServeCOAP(nil, client, wireMessage(t, EncodeCmd(PUBSUB_PATH, msgID, cmd)))
+	}
+
+	create := NewCmd(CMD_CREATE, "cbor", nil)
+	create.Attrs = map[string]string{"ct": "60"}
+	if rv := serve(create); rv.Code != coap.Created {
+		t.Fatal("Create topic with format failed:", rv.Code)
+	}
+	if rv := serve(NewCmd(CMD_CREATE, "bad", []byte("<bad>;ct=abc"))); rv.Code != coap.BadRequest {
+		t.Error("Create topic with invalid format should get 4.00, got:", rv.Code)
+	}
+	if rv := serve(NewCmd(CMD_DISCOVER, "", nil)); string(rv.Payload) != "</ps/cbor>;ct=60;obs" {
+		t.Error("Discover should show format of topic:", string(rv.Payload))
+	}
+
+	pub := NewCmd(CMD_PUBLISH, "cbor", []byte{0xa0})
+	pub.ContentFormat = int(coap.AppJSON)
+	if rv := serve(pub); rv.Code != coap.UnsupportedMediaType {
+		t.Error("Publish with other format should get 4.15, got:", rv.Code)
+	}
+	pub.ContentFormat = 60
+	if rv := serve(pub); rv.Code != coap.Changed {
+		t.Error("Publish with topic format failed:", rv.Code)
+	}
+
+	read := NewCmd(CMD_READ, "cbor", nil)
+	rv := serve(read)
+	if rv.Code != coap.Content || OptionFormat(wireMessage(t, rv), coap.ContentFormat) != 60 {
+		t.Error("Read should return format of topic:", rv.Code, rv.Option(coap.ContentFormat))
+	}
+	read.Accept = int(coap.TextPlain)
+	if rv := serve(read); rv.Code != coap.NotAcceptable {
+		t.Error("Read with other accept should get 4.06, got:", rv.Code)
+	}
+
+	sub := NewCmd(CMD_SUBSCRIBE, "cbor", nil)
+	sub.Accept = int(coap.TextPlain)
+	if rv := serve(sub); rv.Code != coap.NotAcceptable {
+		t.Error("Subscribe with other accept should get 4.06, got:", rv.Code)
+	}
+	sub.Accept = 60
+	if rv := serve(sub); rv.Code != coap.Content || OptionFormat(wireMessage(t, rv), coap.ContentFormat) != 60 {
+		t.Error("Subscribe with topic format failed:", rv.Code)
+	}
+}
+
+func TestBrokerCreateLinkFormat(t *testing.T) {
+	broker := newBroker(t)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	var msgID uint16 = 10
+	post := func(path []string, payload string, format coap.MediaType) *coap.Message {
+		msgID++
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: msgID, Payload: []byte(payload)}
+		m.SetPath(path)
+		m.SetOption(coap.ContentFormat, format)
+		return broker.ServeCOAP(nil, client, wireMessage(t, m))
+	}
+
+	if rv := post([]string{"ps"}, "<sensors>", coap.AppLinkFormat); rv.Code != coap.Created {
+		t.Fatal("Create top level topic failed:", rv.Code)
+	}
+	rv := post([]string{"ps", "sensors"}, `<temp>;ct=50;rt="temperature";title="Room temp";sz=4;foo=1`, coap.AppLinkFormat)
+	if rv.Code != coap.Created || locationPath(wireMessage(t, rv)) != "ps/sensors/temp" {
+		t.Fatal("Create child topic failed:", rv.Code, locationPath(wireMessage(t, rv)))
+	}
+	if rv := post([]string{"ps"}, "<t1>", coap.TextPlain); rv.Code != coap.UnsupportedMediaType {
+		t.Error("Create with other format should get 4.15, got:", rv.Code)
+	}
+	if rv := post([]string{"ps"}, "<t1>,<t2>", coap.AppLinkFormat); rv.Code != coap.BadRequest {
+		t.Error("Create with two links should get 4.00, got:", rv.Code)
+	}
+
+	discover := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_DISCOVER, "", "rt=temperature"))
+	if string(discover.Payload) != `</ps/sensors/temp>;ct=50;obs;rt="temperature";sz=4;title="Room temp"` {
+		t.Error("Discover should show attributes of created topic:", string(discover.Payload))
+	}
+
+	//Legacy create without payload on topic itself
+	legacy := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 4}
+	legacy.SetPathString("ps/legacy")
+	if rv := broker.ServeCOAP(nil, client, legacy); rv.Code != coap.Created {
+		t.Error("Legacy create failed:", rv.Code)
+	}
+}
+
+func TestBrokerDuplicateRequest(t *testing.T) {
+	broker := newBroker(t)
+	broker.ExchangeLifetime = 100 * time.Millisecond
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	read := func(msgID uint16) string {
+		return string(broker.ServeCOAP(nil, other, EncodeMessage(msgID, CMD_READ, "", "t1")).Payload)
+	}
+
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+	first := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "v1", "t1"))
+
+	//Retransmission with same message ID get cached response and not publish again
+	dup := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "v2", "t1"))
+	if dup != first || read(100) != "v1" {
+		t.Error("Duplicate request should get cached response:", dup, read(101))
+	}
+	if broker.Stats().CachedExchanges == 0 {
+		t.Error("Exchange should be cached")
+	}
+
+	//Same message ID with other token is a new request, message ID of client wrap around
+	reused := EncodeMessage(2, CMD_PUBLISH, "v2", "t1")
+	reused.Token = []byte("new")
+	if rv := broker.ServeCOAP(nil, client, reused); rv == first || rv.Code != coap.Changed || read(104) != "v2" {
+		t.Error("Same message ID with other token should be processed:", rv.Code)
+	}
+	reused.Payload = []byte("v5")
+	if rv := broker.ServeCOAP(nil, client, reused); rv.Code != coap.Changed || !bytes.Equal(rv.Token, reused.Token) || read(105) != "v2" {
+		t.Error("Retransmission of new request should get its cached response:", rv.Code)
+	}
+
+	//Same message ID from other endpoint is a new request
+	if rv := broker.ServeCOAP(nil, other, EncodeMessage(2, CMD_PUBLISH, "v3", "t1")); rv.Code != coap.Changed || read(102) != "v3" {
+		t.Error("Same message ID from other address should be processed:", rv.Code)
+	}
+
+	//Message ID could be reused after exchange lifetime
+	time.Sleep(150 * time.Millisecond)
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "v4", "t1")); rv == first || read(103) != "v4" {
+		t.Error("Message ID should be reused after exchange lifetime:", rv.Code)
+	}
+}
+
+func TestBrokerDuplicateNotification(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	pub, _ := coap.Dial("udp", addr)
+	sendCmd(t, pub, 1, CMD_CREATE, "t1", "")
+	sub := subscribeRaw(t, addr, "t1", "dup")
+
+	//Replay same publish, observer only get one notification
+	first := sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	dup := sendCmd(t, pub, 2, CMD_PUBLISH, "t1", "v1")
+	if first == nil || dup == nil || dup.Code != first.Code || dup.MessageID != first.MessageID {
+		t.Fatal("Duplicate publish should get same response:", first, dup)
+	}
+
+	rv, err := sub.Receive()
+	if err != nil || string(rv.Payload) != "v1" {
+		t.Fatal("No notification:", err)
+	}
+	sub.Send(coap.Message{Type: coap.Acknowledgement, MessageID: rv.MessageID})
+	if rv, err := sub.Receive(); err == nil {
+		t.Error("Duplicate publish should not notify again:", rv)
+	}
+}
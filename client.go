@@ -1,186 +1,881 @@
 package coapmq
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-coap"
 )
 
 type subConnection struct {
-	channel   chan string
-	clientCon *coap.Conn
+	//Channel of SubscriptionBytes, nil if subscribe by handler
+	channel chan []byte
+	//Created by Subscription, convert data from channel to string
+	strChannel chan string
+	//Token of observe registration, broker echo it in every notification
+	token []byte
+	//Accept of registration, same one is used to register again after reconnect
+	accept int
+	//Notifications from read loop, handled by goroutine of this subscription
+	notifications chan *coap.Message
+	//Closed when subscription is removed, stop its goroutine even it is blocked by reader
+	stop chan struct{}
+	//Called with each notification in goroutine of this subscription
+	handler func(Notification)
+	//Latest Observe sequence number, older notification is dropped
+	fresh *observeFreshness
+}
+
+//Request waiting for response on client socket
+type pendingRequest struct {
+	token []byte
+	reply chan *coap.Message
 }
 
 type Client struct {
-	msgIndex uint16
-	serAddr  string
-	subList  map[string]subConnection
+	//Block size of blockwise transfer for large payload, 16 to 1024 in power of 2
+	BlockSize int
+	//Buffer size of subscription channel, 0 is unbuffered
+	SubscriptionBuffer int
+	//What to do when subscription channel is full, default POLICY_BLOCK
+	DropPolicy DropPolicy
+
+	msgIDs  *MessageIDGenerator
+	serAddr string
+	//One UDP socket for all requests and subscriptions, messages are dispatched by token and message ID
+	conn    *net.UDPConn
+	subList map[string]subConnection
+	//URI path of pub/sub function set on server, found from /.well-known/core
+	psRoot string
+	lock   sync.RWMutex //protect psRoot and subList
+
+	//Requests waiting for response, by message ID
+	pending     map[uint16]*pendingRequest
+	pendingLock sync.Mutex
+
+	//Connection state, updated by result of each request
+	state       ConnState
+	failures    int
+	stateChan   chan ConnStateEvent
+	stateClosed bool
+	//Subscriptions need register again after reconnect
+	resyncPending bool
+	//Instance ID of broker from heart beat, it change when broker restart
+	brokerInstance []byte
+	//Heart beat interval and reconnect backoff, wake up heart beat by heartBeatReset after change
+	heartBeatInterval time.Duration
+	reconnectMin      time.Duration
+	reconnectMax      time.Duration
+	heartBeatReset    chan struct{}
+	//Message ID is not reused within it
+	exchangeLifetime time.Duration
+	//Retransmission of confirmable request
+	ackTimeout    time.Duration
+	maxRetransmit int
+	stateLock     sync.Mutex //protect state, heart beat interval, reconnect backoff, exchange lifetime and retransmission
+
+	//Closed by Close, stop read loop, heart beat and subscriptions
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // Create a pubsub client for CoAP protocol
 // It will connect to server and make sure it alive and start heart beat
 // To keep udp port open, we will send heart beat event to server every minutes
-func NewClient(servAddr string) *Client {
+func NewClient(servAddr string) (*Client, error) {
+	return NewClientContext(context.Background(), servAddr)
+}
+
+//Same as NewClient, ctx limit the time to connect and find pub/sub root
+func NewClientContext(ctx context.Context, servAddr string) (*Client, error) {
 	c := new(Client)
 	c.subList = make(map[string]subConnection, 0)
+	c.pending = make(map[uint16]*pendingRequest)
+	c.done = make(chan struct{})
+	c.stateChan = make(chan ConnStateEvent, connStateQueueSize)
+	c.heartBeatInterval = DEFAULT_HEART_BEAT
+	c.reconnectMin, c.reconnectMax = DEFAULT_RECONNECT_MIN, DEFAULT_RECONNECT_MAX
+	c.heartBeatReset = make(chan struct{}, 1)
+	c.exchangeLifetime = exchangeLifetime
+	c.ackTimeout, c.maxRetransmit = coap.ResponseTimeout, coap.MaxRetransmit
 	c.serAddr = servAddr
+	c.psRoot = PUBSUB_PATH
+	c.BlockSize = DEFAULT_BLOCK_SIZE
+	c.msgIDs = NewMessageIDGenerator()
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.wg.Add(1)
+	go c.readLoop()
 
 	//Connection check if any error
-	_, err := c.sendReq(CMD_HEARTBEAT, "", "")
+	ret, err := c.sendReq(ctx, CMD_HEARTBEAT, "", nil)
 	if err != nil {
 		log.Println("Cannot connect to server")
-		return nil
+		c.Close()
+		return nil, err
+	}
+	c.brokerRestarted(ret.Payload)
+
+	if _, err := c.FindPubSubRootContext(ctx); err != nil {
+		log.Println("Cannot find pub/sub root, use default:", PUBSUB_PATH)
 	}
-	//Start heart beat
-	c.msgIndex = GetIPv4Int16() + GetLocalRandomInt()
-	log.Println("Init msgID=", c.msgIndex)
+	c.wg.Add(1)
 	go c.heartBeat()
-	return c
+	return c, nil
+}
+
+//Close client socket, stop heart beat and all subscriptions, channels of subscriptions are closed
+//Broker remove the subscriptions after notifications to this client are not acknowledged.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+
+		c.lock.Lock()
+		for topic, sub := range c.subList {
+			close(sub.stop)
+			delete(c.subList, topic)
+		}
+		c.lock.Unlock()
+	})
+	c.wg.Wait()
+	c.closeState()
+	return err
 }
 
 func (c *Client) Publish(topic string, data string) error {
-	_, err := c.sendReq(CMD_PUBLISH, topic, data)
+	return c.PublishBytes(topic, []byte(data))
+}
+
+//Publish binary data on topic, such as CBOR or protobuf
+func (c *Client) PublishBytes(topic string, data []byte) error {
+	return c.PublishContext(context.Background(), topic, data)
+}
+
+//Same as PublishBytes, return ctx error if it is done before response
+func (c *Client) PublishContext(ctx context.Context, topic string, data []byte) error {
+	return c.publish(ctx, NewCmd(CMD_PUBLISH, topic, data))
+}
+
+//Publish data with Content-Format, broker reject it if not match format of topic
+func (c *Client) PublishFormat(topic string, data []byte, format coap.MediaType) error {
+	cmd := NewCmd(CMD_PUBLISH, topic, data)
+	cmd.ContentFormat = int(format)
+	return c.publish(context.Background(), cmd)
+}
+
+//Publish by command from NewCmd(CMD_PUBLISH, topic, data), it carry all options set on cmd
+//such as ContentFormat and MaxAge, return ctx error if it is done before response
+func (c *Client) PublishCmd(ctx context.Context, cmd *Cmd) error {
+	if cmd.Type != CMD_PUBLISH {
+		return errors.New("Command is not publish")
+	}
+	return c.publish(ctx, cmd)
+}
+
+func (c *Client) publish(ctx context.Context, cmd *Cmd) error {
+	ret, err := c.sendCmd(ctx, cmd)
 	if err != nil {
 		log.Println("pub error:", err)
+		return err
 	}
-
-	return err
+	return ErrorWrapper(ret.Code, nil)
 }
 
 //Add Subscription on topic and return a channel for user to wait data
+//It share same subscription with SubscriptionBytes, only use one of them on a topic.
 func (c *Client) Subscription(topic string) (chan string, error) {
+	c.lock.RLock()
+	val, exist := c.subList[topic]
+	c.lock.RUnlock()
+	if exist && val.strChannel != nil {
+		return val.strChannel, nil
+	}
+
+	subChan, err := c.SubscriptionBytes(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	strChan := make(chan string)
+	c.lock.Lock()
+	clientConn, exist := c.subList[topic]
+	if exist {
+		clientConn.strChannel = strChan
+		c.subList[topic] = clientConn
+	}
+	c.lock.Unlock()
+
+	go func() {
+		defer close(strChan)
+		for data := range subChan {
+			select {
+			case strChan <- string(data):
+			case <-clientConn.stop:
+				return
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return strChan, nil
+}
+
+//Add Subscription on topic and return a channel for user to wait binary data
+func (c *Client) SubscriptionBytes(topic string) (chan []byte, error) {
+	return c.SubscriptionContext(context.Background(), topic)
+}
+
+//Same as SubscriptionBytes, subscription last until ctx is done
+//Client send Observe deregistration to broker and close the channel when ctx is done.
+//Registration fail after retransmissions even ctx has a later deadline, see SetRetransmit.
+func (c *Client) SubscriptionContext(ctx context.Context, topic string) (chan []byte, error) {
+	return c.subscribeChannel(ctx, NewCmd(CMD_SUBSCRIBE, topic, nil))
+}
+
+//Same as SubscriptionBytes, broker reject it if accept not match format of topic
+func (c *Client) SubscriptionFormat(topic string, accept coap.MediaType) (chan []byte, error) {
+	cmd := NewCmd(CMD_SUBSCRIBE, topic, nil)
+	cmd.Accept = int(accept)
+	return c.subscribeChannel(context.Background(), cmd)
+}
+
+//Same as SubscriptionContext by command from NewCmd(CMD_SUBSCRIBE, topic, nil), it carry Accept set on cmd
+func (c *Client) SubscriptionCmd(ctx context.Context, cmd *Cmd) (chan []byte, error) {
+	if cmd.Type != CMD_SUBSCRIBE {
+		return nil, errors.New("Command is not subscribe")
+	}
+	return c.subscribeChannel(ctx, cmd)
+}
+
+//Subscribe with channel, payload is sent to channel by DropPolicy
+func (c *Client) subscribeChannel(ctx context.Context, cmd *Cmd) (chan []byte, error) {
+	ch := make(chan []byte, c.SubscriptionBuffer)
+	stop := make(chan struct{})
+	policy := c.DropPolicy
+	sub, _, err := c.subscribe(ctx, cmd, subConnection{channel: ch, stop: stop, handler: func(n Notification) {
+		c.sendChannel(ctx, stop, ch, n.Payload, policy)
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if sub.channel == nil {
+		return nil, errors.New("Already subscribe this topic by handler.")
+	}
+	return sub.channel, nil
+}
+
+//Register subscription on broker, sub is filled with token and delivery queue
+//Return exist subscription and false if topic already subscribed.
+func (c *Client) subscribe(ctx context.Context, cmd *Cmd, sub subConnection) (subConnection, bool, error) {
+	topic := cmd.Topic
+	//Add subscription before request, notification could arrive before response
+	sub.token = NewToken()
+	sub.accept = cmd.Accept
+	sub.notifications = make(chan *coap.Message, subscriptionQueueSize)
+	sub.fresh = new(observeFreshness)
+	c.lock.Lock()
+	select {
+	case <-c.done:
+		c.lock.Unlock()
+		return sub, false, ErrClientClosed
+	default:
+	}
 	if val, exist := c.subList[topic]; exist {
 		//if topic already exist in sub, return and not send to server
-		return val.channel, nil
+		c.lock.Unlock()
+		return val, false, nil
 	}
+	c.subList[topic] = sub
+	c.lock.Unlock()
 
-	conn, err := c.sendWaitingReq(CMD_SUBSCRIBE, topic, "")
+	reqMsg := EncodeCmd(c.root(), c.getMsgID(), cmd)
+	reqMsg.Token = sub.token
+	ret, err := c.exchange(ctx, reqMsg)
+	if err == nil {
+		ret, err = c.fetchBlock2(ctx, reqMsg.Path(), nil, cmd.Accept, ret)
+	}
+	if err == nil {
+		err = ErrorWrapper(ret.Code, nil)
+	}
 	if err != nil {
-		return nil, err
+		c.removeSubscription(topic, sub)
+		if ctx.Err() != nil || err == ErrRequestTimeout {
+			//Broker may already register it
+			c.deregister(topic, sub)
+		}
+		return sub, false, err
+	}
+
+	//Registration response is the first notification
+	sub.fresh.reset(observeSeq(ret), time.Now())
+	c.wg.Add(1)
+	go c.waitSubResponse(ctx, sub, topic)
+	return sub, true, nil
+}
+
+//Send Observe deregistration with token of subscription, broker stop notification on it (RFC 7641 section 3.6)
+func (c *Client) deregister(topic string, sub subConnection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), coap.ResponseTimeout)
+	defer cancel()
+	reqMsg := EncodeCmd(c.root(), c.getMsgID(), NewCmd(CMD_UNSUBSCRIBE, topic, nil))
+	reqMsg.Token = sub.token
+	ret, err := c.exchange(ctx, reqMsg)
+	if err != nil {
+		return err
 	}
+	return ErrorWrapper(ret.Code, nil)
+}
 
-	subChan := make(chan string)
-	go c.waitSubResponse(conn, subChan, topic)
+//Remove subscription from list if it is not replaced or removed by Close
+func (c *Client) removeSubscription(topic string, sub subConnection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if val, exist := c.subList[topic]; exist && bytes.Equal(val.token, sub.token) {
+		close(sub.stop)
+		delete(c.subList, topic)
+	}
+}
 
-	//Add client connection into member variable for heart beat
-	clientConn := subConnection{channel: subChan, clientCon: conn}
-	c.subList[topic] = clientConn
-	return subChan, nil
+//Create topic on server with link-format attributes, such as {"rt": "temperature", "ct": "50"}
+//Broker keep "rt", "ct", "if", "title" and "sz", attrs could be nil. Return URI of created topic.
+func (c *Client) CreateTopic(topic string, attrs map[string]string) (string, error) {
+	return c.CreateTopicContext(context.Background(), topic, attrs)
 }
 
-//Create topic on server
-func (c *Client) CreateTopic(topic string) error {
-	ret, err := c.sendReq(CMD_CREATE, topic, "")
+//Same as CreateTopic, return ctx error if it is done before response
+func (c *Client) CreateTopicContext(ctx context.Context, topic string, attrs map[string]string) (string, error) {
+	cmd := NewCmd(CMD_CREATE, topic, nil)
+	cmd.Attrs = attrs
+	ret, err := c.sendCmd(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
 	log.Println("Result:", ret.Code)
-	return ErrorWrapper(ret.Code, err)
+	if err := ErrorWrapper(ret.Code, nil); err != nil {
+		return "", err
+	}
+
+	var location []string
+	for _, seg := range ret.Options(coap.LocationPath) {
+		if v, ok := seg.(string); ok {
+			location = append(location, v)
+		}
+	}
+	if len(location) == 0 {
+		//Broker not return location, topic is under our root
+		location = append([]string{c.root()}, SplitTopic(topic)...)
+	}
+	return "/" + JoinTopic(location), nil
+}
+
+//Create topic with Content-Format, it is "ct" attribute of topic
+//Broker reject publish, read and subscribe with other format on this topic.
+func (c *Client) CreateTopicFormat(topic string, format coap.MediaType) (string, error) {
+	return c.CreateTopic(topic, map[string]string{"ct": strconv.Itoa(int(format))})
 }
 
 //Remove topic on server
 func (c *Client) RemoveTopic(topic string) error {
-	ret, err := c.sendReq(CMD_REMOVE, topic, "")
+	return c.RemoveTopicContext(context.Background(), topic)
+}
+
+//Same as RemoveTopic, return ctx error if it is done before response
+func (c *Client) RemoveTopicContext(ctx context.Context, topic string) error {
+	ret, err := c.sendReq(ctx, CMD_REMOVE, topic, nil)
+	if err != nil {
+		return err
+	}
 	log.Println("Result:", ret.Code)
-	return ErrorWrapper(ret.Code, err)
+	return ErrorWrapper(ret.Code, nil)
+}
+
+//Discovery and query with topic filter, such as "rt=temperature&ct=0"
+//Empty filter will return all topics on server
+func (c *Client) DiscoveryTopic(queryFilter string) ([]Link, error) {
+	return c.DiscoveryTopicContext(context.Background(), queryFilter)
+}
+
+//Same as DiscoveryTopic, return ctx error if it is done before response
+func (c *Client) DiscoveryTopicContext(ctx context.Context, queryFilter string) ([]Link, error) {
+	ret, err := c.sendReq(ctx, CMD_DISCOVER, queryFilter, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ErrorWrapper(ret.Code, nil); err != nil {
+		return nil, err
+	}
+
+	log.Println("Result:", ret.Code, " links=", string(ret.Payload))
+	return ParseLinkFormat(string(ret.Payload))
 }
 
-//Discovery and query with topic filter
-func (c *Client) DiscoveryTopic(queryFilter string) (string, error) {
-	//TODO. Need work detail on query filter on serer side
-	return "", errors.New("NOT IMPLEMENT")
+//Find pub/sub function set on server by GET /.well-known/core?rt=core.ps
+//Client will send all later request to the found root, return the root URI
+func (c *Client) FindPubSubRoot() (string, error) {
+	return c.FindPubSubRootContext(context.Background())
+}
+
+//Same as FindPubSubRoot, return ctx error if it is done before response
+func (c *Client) FindPubSubRootContext(ctx context.Context) (string, error) {
+	ret, err := c.sendReq(ctx, CMD_WELLKNOWN_CORE, "rt="+PUBSUB_RT, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := ErrorWrapper(ret.Code, nil); err != nil {
+		return "", err
+	}
+
+	links, err := ParseLinkFormat(string(ret.Payload))
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		if link.Match([]string{"rt=" + PUBSUB_RT}) {
+			c.lock.Lock()
+			c.psRoot = strings.Trim(link.URI, "/")
+			c.lock.Unlock()
+			log.Println("Found pub/sub root:", link.URI)
+			return link.URI, nil
+		}
+	}
+	return "", errors.New("No pub/sub function set on server")
 }
 
 //Read topic most updated value from server, return error if topic not exist
 func (c *Client) ReadTopic(topic string) (string, error) {
-	ret, err := c.sendReq(CMD_READ, topic, "")
+	data, err := c.ReadTopicBytes(topic)
+	return string(data), err
+}
+
+//Read topic most updated binary value from server, return error if topic not exist
+func (c *Client) ReadTopicBytes(topic string) ([]byte, error) {
+	return c.ReadTopicContext(context.Background(), topic)
+}
+
+//Same as ReadTopicBytes, return ctx error if it is done before response
+func (c *Client) ReadTopicContext(ctx context.Context, topic string) ([]byte, error) {
+	data, _, err := c.readTopic(ctx, NewCmd(CMD_READ, topic, nil))
+	return data, err
+}
+
+//Read topic value and its Content-Format, return error if accept not match format of topic
+func (c *Client) ReadTopicFormat(topic string, accept coap.MediaType) ([]byte, int, error) {
+	cmd := NewCmd(CMD_READ, topic, nil)
+	cmd.Accept = int(accept)
+	return c.readTopic(context.Background(), cmd)
+}
+
+//Read topic value and its Content-Format by command from NewCmd(CMD_READ, topic, nil), it carry Accept set on cmd
+func (c *Client) ReadTopicCmd(ctx context.Context, cmd *Cmd) ([]byte, int, error) {
+	if cmd.Type != CMD_READ {
+		return nil, CONTENT_FORMAT_NONE, errors.New("Command is not read")
+	}
+	return c.readTopic(ctx, cmd)
+}
+
+func (c *Client) readTopic(ctx context.Context, cmd *Cmd) ([]byte, int, error) {
+	ret, err := c.sendCmd(ctx, cmd)
 	if err != nil {
-		return "", ErrorWrapper(ret.Code, err)
+		return nil, CONTENT_FORMAT_NONE, err
+	}
+	if err := ErrorWrapper(ret.Code, nil); err != nil {
+		return nil, CONTENT_FORMAT_NONE, err
 	}
 
-	log.Println("Result:", ret.Code, " value=", string(ret.Payload))
-	return string(ret.Payload), nil
+	log.Println("Result:", ret.Code, " len=", len(ret.Payload))
+	return ret.Payload, OptionFormat(ret, coap.ContentFormat), nil
+}
+
+//Read values of topic published at or after since, only the latest limit ones if limit > 0
+//Zero since read all values kept by broker.
+func (c *Client) ReadHistory(topic string, since time.Time, limit int) ([]HistoryEntry, error) {
+	return c.ReadHistoryContext(context.Background(), topic, since, limit)
+}
+
+//Same as ReadHistory, return ctx error if it is done before response
+func (c *Client) ReadHistoryContext(ctx context.Context, topic string, since time.Time, limit int) ([]HistoryEntry, error) {
+	cmd := NewCmd(CMD_READ, topic, nil)
+	cmd.Query = EncodeHistoryQuery(since, limit)
+	data, _, err := c.readTopic(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-//Remove Subscribetion on topic
+//Remove Subscribetion on topic, its goroutine is stopped and channel is closed
+//Subscription is removed even deregistration failed, broker get RST on next notification then.
 func (c *Client) UnsubscribeTopic(topic string) error {
-	if _, exist := c.subList[topic]; !exist {
+	c.lock.RLock()
+	sub, exist := c.subList[topic]
+	c.lock.RUnlock()
+	if !exist {
 		//if topic not in sub list, return and not send to server
 		return errors.New("Not subscribe this topic before.")
 	}
 
-	ret, err := c.sendReq(CMD_UNSUBSCRIBE, topic, "")
-	log.Println("Result:", ret.Code, " Err=", err, " detail err=", ErrorWrapper(ret.Code, err))
-	return ErrorWrapper(ret.Code, err)
+	c.removeSubscription(topic, sub)
+	err := c.deregister(topic, sub)
+	log.Println("Unsubscribe topic:", topic, " err=", err)
+	return err
+}
+
+func (c *Client) sendReq(ctx context.Context, cmd CMD_TYPE, topic string, payload []byte) (*coap.Message, error) {
+	return c.send(ctx, EncodeRootMessageBytes(c.root(), c.getMsgID(), cmd, payload, topic))
 }
 
-func (c *Client) sendWaitingReq(cmd CMD_TYPE, topic string, msg string) (*coap.Conn, error) {
-	reqMsg := EncodeMessage(c.getMsgID(), cmd, msg, topic)
+func (c *Client) sendCmd(ctx context.Context, cmd *Cmd) (*coap.Message, error) {
+	return c.send(ctx, EncodeCmd(c.root(), c.getMsgID(), cmd))
+}
+
+//Send request and wait response, large payload is sent and received by blockwise transfer
+func (c *Client) send(ctx context.Context, reqMsg *coap.Message) (*coap.Message, error) {
+	reqMsg.Token = NewToken()
 	log.Println("path=", reqMsg.Path())
-	conn, err := coap.Dial("udp", c.serAddr)
-	if err != nil {
-		log.Printf(">>Error dialing: %v \n", err)
-		return nil, errors.New("Dial failed")
+
+	var ret *coap.Message
+	var err error
+	if reqMsg.Code == coap.PUT && len(reqMsg.Payload) > validBlockSize(c.BlockSize) {
+		ret, err = c.sendBlock1(ctx, reqMsg)
+	} else {
+		ret, err = c.exchange(ctx, reqMsg)
+	}
+	if err != nil || ret == nil {
+		return ret, err
 	}
-	conn.Send(*reqMsg)
-	log.Println("msg->", *reqMsg)
-	return conn, err
+	return c.fetchBlock2(ctx, reqMsg.Path(), decodeQuery(reqMsg), OptionFormat(reqMsg, coap.Accept), ret)
 }
 
-func (c *Client) sendReq(cmd CMD_TYPE, topic string, msg string) (*coap.Message, error) {
-	reqMsg := EncodeMessage(c.getMsgID(), cmd, msg, topic)
-	log.Println("path=", reqMsg.Path())
-	conn, err := coap.Dial("udp", c.serAddr)
-	if err != nil {
-		log.Printf(">>Error dialing: %v \n", err)
-		return nil, errors.New("Dial failed")
+func (c *Client) dial() (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.serAddr)
+	if err == nil {
+		var conn *net.UDPConn
+		if conn, err = net.DialUDP("udp", nil, addr); err == nil {
+			return conn, nil
+		}
 	}
-	return conn.Send(*reqMsg)
+	log.Printf(">>Error dialing: %v \n", err)
+	return nil, errors.New("Dial failed")
 }
 
-func (c *Client) waitSubResponse(conn *coap.Conn, ch chan string, topic string) {
-	log.Println("start to wait sub")
-	var rv *coap.Message
-	var err error
-	var keepLoop bool
-	keepLoop = true
-	for keepLoop {
-		if rv != nil {
-			if err != nil {
-				log.Fatalf("Error receiving: %v", err)
+//Send payload by Block1, broker reply 2.31 Continue for each block except the last one
+func (c *Client) sendBlock1(ctx context.Context, reqMsg *coap.Message) (*coap.Message, error) {
+	size := validBlockSize(c.BlockSize)
+	offset := 0
+	for {
+		data, more, err := sliceBlock(reqMsg.Payload, uint32(offset/size), size)
+		if err != nil {
+			return nil, err
+		}
+		m := *reqMsg
+		m.MessageID = c.getMsgID()
+		m.Payload = data
+		m.SetOption(BLOCK1, Block{Num: uint32(offset / size), More: more, Size: size}.Value())
+
+		ret, err := c.exchange(ctx, &m)
+		if err != nil || ret.Code != CONTINUE || !more {
+			return ret, err
+		}
+		offset += len(data)
+		//Broker could ask for smaller block
+		if block, exist := BlockOption(ret, BLOCK1); exist && block.Size < size {
+			size = block.Size
+		}
+	}
+}
+
+//Get remain blocks of response by GET on path and query, return response with full payload
+func (c *Client) fetchBlock2(ctx context.Context, path []string, query []string, accept int, ret *coap.Message) (*coap.Message, error) {
+	block, exist := BlockOption(ret, BLOCK2)
+	if !exist || !block.More {
+		return ret, nil
+	}
+
+	etag, _ := ret.Option(coap.ETag).([]byte)
+	payload := append([]byte(nil), ret.Payload...)
+	for block.More {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: c.getMsgID(), Token: NewToken()}
+		m.SetPath(path)
+		for _, q := range query {
+			m.AddOption(coap.URIQuery, q)
+		}
+		if accept != CONTENT_FORMAT_NONE {
+			m.SetOption(coap.Accept, accept)
+		}
+		m.SetOption(BLOCK2, Block{Num: block.Num + 1, Size: block.Size}.Value())
+
+		next, err := c.exchange(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		if next.Code != coap.Content {
+			return next, nil
+		}
+		nextBlock, exist := BlockOption(next, BLOCK2)
+		if !exist || nextBlock.Num != block.Num+1 {
+			return nil, errors.New("Invalid Block2 in response")
+		}
+		if tag, _ := next.Option(coap.ETag).([]byte); !bytes.Equal(tag, etag) {
+			return nil, errors.New("Value changed during blockwise transfer")
+		}
+		payload = append(payload, next.Payload...)
+		block = nextBlock
+	}
+
+	ret.Payload = payload
+	ret.RemoveOption(BLOCK2)
+	return ret, nil
+}
+
+//Send request on client socket and wait response with same message ID and token
+//Confirmable request is retransmitted with exponential backoff (RFC 7252 section 4.2),
+//it fail with ErrRequestTimeout after MaxRetransmit, or ctx error if ctx is done before that.
+func (c *Client) exchange(ctx context.Context, reqMsg *coap.Message) (*coap.Message, error) {
+	select {
+	case <-c.done:
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	p := &pendingRequest{token: reqMsg.Token, reply: make(chan *coap.Message, 1)}
+	if reqMsg.IsConfirmable() {
+		c.pendingLock.Lock()
+		c.pending[reqMsg.MessageID] = p
+		c.pendingLock.Unlock()
+		defer func() {
+			c.pendingLock.Lock()
+			delete(c.pending, reqMsg.MessageID)
+			c.pendingLock.Unlock()
+		}()
+	}
+
+	if err := coap.Transmit(c.conn, nil, *reqMsg); err != nil {
+		c.requestResult(err)
+		return nil, err
+	}
+	if !reqMsg.IsConfirmable() {
+		return nil, nil
+	}
+
+	ackTimeout, maxRetransmit := c.getRetransmit()
+	//Initial timeout is random between ACK_TIMEOUT and ACK_TIMEOUT * ACK_RANDOM_FACTOR
+	timeout := ackTimeout + time.Duration(rand.Float64()*(coap.ResponseRandomFactor-1)*float64(ackTimeout))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for retransmits := 0; ; {
+		select {
+		case rv := <-p.reply:
+			c.requestResult(nil)
+			if rv.Type == coap.Reset {
+				return nil, errors.New("Request reset by server")
+			}
+			return rv, nil
+		case <-timer.C:
+			if retransmits >= maxRetransmit {
+				c.requestResult(ErrRequestTimeout)
+				return nil, ErrRequestTimeout
+			}
+			retransmits++
+			timeout *= 2
+			log.Println("Retransmit request, msgID:", reqMsg.MessageID, " retransmits:", retransmits)
+			if err := coap.Transmit(c.conn, nil, *reqMsg); err != nil {
+				c.requestResult(err)
+				return nil, err
+			}
+			timer.Reset(timeout)
+		case <-ctx.Done():
+			//Cancelled by caller is not failure of broker
+			if ctx.Err() == context.DeadlineExceeded {
+				c.requestResult(ctx.Err())
 			}
-			log.Printf("Got %s", rv.Payload)
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrClientClosed
 		}
-		rv, err = conn.Receive()
+	}
+}
 
-		if err == nil {
-			ch <- string(rv.Payload)
+//Read all messages on client socket, response goes to waiting request and notification goes to its subscription
+func (c *Client) readLoop() {
+	defer c.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			//Connected UDP socket report ICMP port unreachable as error, keep reading
+			log.Println("Read error:", err)
+			continue
 		}
+		//Payload of message refer to data, buffer is reused by next read
+		m, err := parseMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			log.Println("Drop invalid message:", err)
+			continue
+		}
+		c.dispatch(m)
+	}
+}
 
-		time.Sleep(time.Second)
-		if _, exist := c.subList[topic]; !exist {
-			//sub topic already remove, leave loop
-			log.Println("Loop topic:", topic, " already remove leave loop")
-			keepLoop = false
+func (c *Client) dispatch(m *coap.Message) {
+	if m.Type == coap.Acknowledgement || m.Type == coap.Reset {
+		c.pendingLock.Lock()
+		if p, exist := c.pending[m.MessageID]; exist && (m.Type == coap.Reset || bytes.Equal(m.Token, p.token)) {
+			delete(c.pending, m.MessageID)
+			p.reply <- m
 		}
+		c.pendingLock.Unlock()
+		return
+	}
+
+	known := false
+	c.lock.RLock()
+	for _, sub := range c.subList {
+		if bytes.Equal(sub.token, m.Token) {
+			known = true
+			queueNotification(sub.notifications, m)
+			break
+		}
+	}
+	c.lock.RUnlock()
+
+	if !m.IsConfirmable() {
+		return
+	}
+	if known {
+		//ACK confirmable notification even subscription is busy, or broker will retransmit and evict this subscription
+		coap.Transmit(c.conn, nil, coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID})
+	} else {
+		//Reject notification of unknown subscription, broker remove its observer (RFC 7641 section 3.6)
+		coap.Transmit(c.conn, nil, coap.Message{Type: coap.Reset, MessageID: m.MessageID})
 	}
-	log.Println("Leave wait sub")
 }
 
-func (c *Client) getMsgID() uint16 {
-	c.msgIndex = c.msgIndex + 1
-	return c.msgIndex
+//Queue notification for subscription, drop oldest queued one if reader is too slow
+//Observer only care latest state (RFC 7641 section 1.3), and error notification is always the latest one.
+func queueNotification(queue chan *coap.Message, m *coap.Message) {
+	for {
+		select {
+		case queue <- m:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			log.Println("Subscription busy, drop oldest notification")
+		default:
+		}
+	}
 }
 
-func (c *Client) heartBeat() {
-	log.Println("Starting heart beat loop call")
+//Deliver notifications of one subscription until it is removed or ctx is done, channel is closed after that
+func (c *Client) waitSubResponse(ctx context.Context, sub subConnection, topic string) {
+	defer c.wg.Done()
+	if sub.channel != nil {
+		defer close(sub.channel)
+	}
+	log.Println("start to wait sub")
 
 	for {
-		_, err := c.sendReq(CMD_HEARTBEAT, "", "")
-		if err != nil {
-			log.Fatal("Server lost!")
+		select {
+		case <-sub.stop:
+			log.Println("Leave wait sub")
+			return
+		case rv := <-sub.notifications:
+			if rv.Code == coap.ServiceUnavailable {
+				//Broker is shutting down, register again after it is back
+				log.Println("Subscription on topic:", topic, " unavailable, wait to resync")
+				c.requestResync()
+				continue
+			}
+			if rv.Code >= coap.BadRequest {
+				//Error notification end the observation (RFC 7641 section 3.2)
+				log.Println("Subscription on topic:", topic, " ended by broker:", rv.Code)
+				c.removeSubscription(topic, sub)
+				return
+			}
+			//Skip retransmission and notification older than delivered one
+			if sub.fresh.update(observeSeq(rv), time.Now()) {
+				c.deliverNotification(ctx, rv, sub, topic)
+			}
+		case <-ctx.Done():
+			c.removeSubscription(topic, sub)
+			if err := c.deregister(topic, sub); err != nil {
+				log.Println("Deregister topic:", topic, " failed:", err)
+			}
+			log.Println("Subscription on topic:", topic, " cancelled")
 			return
 		}
-		log.Println("Send the heart beat")
-		time.Sleep(time.Minute)
 	}
 }
+
+//Pass notification to handler of subscription, get remain blocks first if it is large
+func (c *Client) deliverNotification(ctx context.Context, rv *coap.Message, sub subConnection, topic string) {
+	received := time.Now()
+	var path []string
+	for _, seg := range rv.Options(coap.LocationPath) {
+		if v, ok := seg.(string); ok {
+			path = append(path, v)
+		}
+	}
+	//Location-Path is topic of value, it is different from subscription on wildcard filter
+	rootLen := len(SplitTopic(c.root()))
+	if len(path) > rootLen {
+		topic = JoinTopic(path[rootLen:])
+	} else {
+		path = EncodeCmdsToRootPath(c.root(), CMD_READ, topic)
+	}
+
+	rv, err := c.fetchBlock2(ctx, path, nil, sub.accept, rv)
+	if err != nil {
+		log.Println("Get blocks of notification failed:", err)
+		return
+	}
+	sub.handler(Notification{
+		Topic:         topic,
+		Payload:       rv.Payload,
+		ContentFormat: OptionFormat(rv, coap.ContentFormat),
+		Observe:       observeSeq(rv),
+		Received:      received,
+	})
+}
+
+func (c *Client) root() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.psRoot
+}
+
+//Message ID of new request, it wait if more than 65536 requests are sent within exchange lifetime
+func (c *Client) getMsgID() uint16 {
+	return c.msgIDs.NextWithin(c.serAddr, c.getExchangeLifetime())
+}
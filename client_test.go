@@ -0,0 +1,582 @@
+package coapmq_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+//Connect client to broker, it is closed when test end
+func newClient(t testing.TB, addr string) *Client {
+	client, err := NewClient(addr)
+	if err != nil {
+		t.Fatal("Connect to broker failed:", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestClientDiscoveryTopic(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	client.CreateTopic("t2", nil)
+
+	links, err := client.DiscoveryTopic("")
+	if err != nil || len(links) != 2 || links[0].URI != "/ps/t1" || links[1].URI != "/ps/t2" {
+		t.Error("Discover all topics failed:", links, err)
+	}
+
+	links, err = client.DiscoveryTopic("href=/ps/t2")
+	if err != nil || len(links) != 1 || links[0].URI != "/ps/t2" {
+		t.Error("Discover with filter failed:", links, err)
+	}
+}
+
+func TestClientFindPubSubRoot(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	root, err := client.FindPubSubRoot()
+	if err != nil || root != "/ps" {
+		t.Error("Find pub/sub root failed:", root, err)
+	}
+}
+
+func TestClientHierarchicalTopic(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	if _, err := client.CreateTopic("sensors", nil); err != nil {
+		t.Fatal("Create topic failed:", err)
+	}
+	if _, err := client.CreateTopic(JoinTopic([]string{"sensors", "temp"}), nil); err != nil {
+		t.Fatal("Create child topic failed:", err)
+	}
+	client.Publish("sensors/temp", "21")
+	if val, err := client.ReadTopic("sensors/temp"); err != nil || val != "21" {
+		t.Error("Read child topic failed:", val, err)
+	}
+	if err := client.RemoveTopic("sensors"); err != nil {
+		t.Error("Remove topic failed:", err)
+	}
+	if links, _ := client.DiscoveryTopic(""); len(links) != 0 {
+		t.Error("Topics should be removed:", links)
+	}
+}
+
+func TestClientBinaryPayload(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	if _, err := client.CreateTopic("cbor", nil); err != nil {
+		t.Fatal("Create topic failed:", err)
+	}
+	ch, err := client.SubscriptionBytes("cbor")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	data := []byte{0xa1, 0x00, 0x61, 0x00, 0xff, 0x00}
+	if err := client.PublishBytes("cbor", data); err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+	if val, err := client.ReadTopicBytes("cbor"); err != nil || !bytes.Equal(val, data) {
+		t.Error("Read binary value failed:", val, err)
+	}
+	select {
+	case val := <-ch:
+		if !bytes.Equal(val, data) {
+			t.Error("Notification of binary value failed:", val)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("No notification of binary value")
+	}
+
+	if _, err := client.ReadTopicBytes("none"); err == nil {
+		t.Error("Read not exist topic should return error")
+	}
+}
+
+func TestClientTopicPath(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	ctx := context.Background()
+	client.CreateTopic("sensors", nil)
+	if uri, err := client.CreateTopicPath(ctx, []string{"sensors", "temp"}, nil); err != nil || uri != "/ps/sensors/temp" {
+		t.Fatal("Create topic by path failed:", uri, err)
+	}
+	ch, err := client.SubscriptionPath(ctx, []string{"sensors", "temp"})
+	if err != nil {
+		t.Fatal("Subscribe by path failed:", err)
+	}
+	if err := client.PublishPath(ctx, []string{"sensors", "temp"}, []byte("21")); err != nil {
+		t.Error("Publish by path failed:", err)
+	}
+	select {
+	case v := <-ch:
+		if string(v) != "21" {
+			t.Error("Wrong notification:", string(v))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("No notification of topic by path")
+	}
+	if val, err := client.ReadTopicPath(ctx, []string{"sensors", "temp"}); err != nil || string(val) != "21" {
+		t.Error("Read topic by path failed:", string(val), err)
+	}
+
+	//Segment must not hide more levels
+	for _, segs := range [][]string{{"sensors/temp"}, {"sensors", ""}, nil} {
+		if err := client.PublishPath(ctx, segs, []byte("22")); err == nil {
+			t.Error("Publish with invalid segments should fail:", segs)
+		}
+		if _, err := client.SubscriptionPath(ctx, segs); err == nil {
+			t.Error("Subscribe with invalid segments should fail:", segs)
+		}
+	}
+	if val, _ := client.ReadTopic("sensors/temp"); val != "21" {
+		t.Error("Rejected publish should not change value:", val)
+	}
+	if err := client.RemoveTopicPath(ctx, []string{"sensors"}); err != nil {
+		t.Error("Remove topic by path failed:", err)
+	}
+}
+
+func TestClientContentFormat(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	if _, err := client.CreateTopicFormat("json", coap.AppJSON); err != nil {
+		t.Fatal("Create topic with format failed:", err)
+	}
+	if err := client.PublishFormat("json", []byte("21"), coap.TextPlain); err == nil {
+		t.Error("Publish with other format should fail")
+	}
+	if err := client.PublishFormat("json", []byte(`{"t":21}`), coap.AppJSON); err != nil {
+		t.Error("Publish with topic format failed:", err)
+	}
+	if val, format, err := client.ReadTopicFormat("json", coap.AppJSON); err != nil || string(val) != `{"t":21}` || format != int(coap.AppJSON) {
+		t.Error("Read with format failed:", string(val), format, err)
+	}
+	if _, err := client.SubscriptionFormat("json", coap.TextPlain); err == nil {
+		t.Error("Subscribe with other accept should fail")
+	}
+}
+
+func TestClientPublishCmd(t *testing.T) {
+	clock := newFakeClock()
+	broker := newBroker(t)
+	broker.Clock = clock
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	if _, err := client.CreateTopicFormat("json", coap.AppJSON); err != nil {
+		t.Fatal("Create topic with format failed:", err)
+	}
+	ctx := context.Background()
+	if err := client.PublishCmd(ctx, NewCmd(CMD_READ, "json", nil)); err == nil {
+		t.Error("Publish by other command should fail")
+	}
+
+	//Content-Format and Max-Age on same publish
+	pub := NewCmd(CMD_PUBLISH, "json", []byte(`{"t":21}`))
+	pub.ContentFormat = int(coap.AppJSON)
+	pub.MaxAge = 10 * time.Second
+	if err := client.PublishCmd(ctx, pub); err != nil {
+		t.Fatal("Publish with format and Max-Age failed:", err)
+	}
+	read := NewCmd(CMD_READ, "json", nil)
+	read.Accept = int(coap.AppJSON)
+	if val, format, err := client.ReadTopicCmd(ctx, read); err != nil || string(val) != `{"t":21}` || format != int(coap.AppJSON) {
+		t.Error("Read with accept failed:", string(val), format, err)
+	}
+
+	clock.Advance(10 * time.Second)
+	if val, _, err := client.ReadTopicCmd(ctx, read); err != nil || len(val) != 0 {
+		t.Error("Value should be cleared after Max-Age:", string(val), err)
+	}
+
+	sub := NewCmd(CMD_SUBSCRIBE, "json", nil)
+	sub.Accept = int(coap.TextPlain)
+	if _, err := client.SubscriptionCmd(ctx, sub); err == nil {
+		t.Error("Subscribe with other accept should fail")
+	}
+}
+
+func TestClientCreateTopicAttrs(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	if uri, err := client.CreateTopic("sensors", nil); err != nil || uri != "/ps/sensors" {
+		t.Fatal("Create topic failed:", uri, err)
+	}
+	uri, err := client.CreateTopic("sensors/temp", map[string]string{"rt": "temperature", "ct": "50"})
+	if err != nil || uri != "/ps/sensors/temp" {
+		t.Fatal("Create child topic failed:", uri, err)
+	}
+	links, err := client.DiscoveryTopic("rt=temperature")
+	if err != nil || len(links) != 1 || links[0].URI != uri || links[0].Params["ct"] != "50" {
+		t.Error("Discover created topic failed:", links, err)
+	}
+	if _, err := client.CreateTopic("sensors/temp", nil); err == nil {
+		t.Error("Create exist topic should fail")
+	}
+}
+
+func TestClientSharedSocket(t *testing.T) {
+	broker, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+
+	topics := []string{"t1", "t2", "t3"}
+	chans := make([]chan []byte, len(topics))
+	for i, topic := range topics {
+		client.CreateTopic(topic, nil)
+		ch, err := client.SubscriptionBytes(topic)
+		if err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+		chans[i] = ch
+	}
+
+	//Requests in parallel on same socket get their own response
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			if err := client.Publish(topic, "v-"+topic); err != nil {
+				t.Error("Publish failed:", err)
+			}
+		}(topic)
+	}
+	wg.Wait()
+
+	for i, ch := range chans {
+		select {
+		case val := <-ch:
+			if string(val) != "v-"+topics[i] {
+				t.Error("Notification dispatched to wrong subscription:", topics[i], string(val))
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("No notification on topic:", topics[i])
+		}
+	}
+
+	states := broker.DeliveryStates()
+	if len(states) != len(topics) {
+		t.Fatal("Subscribers wrong:", states)
+	}
+	for _, state := range states {
+		if state.Address != states[0].Address {
+			t.Error("Subscriptions should share one socket:", state.Address, states[0].Address)
+		}
+	}
+}
+
+func TestClientMessageIDWraparound(t *testing.T) {
+	broker := newBroker(t)
+	broker.ExchangeLifetime = time.Second
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.SetExchangeLifetime(time.Second)
+	client.CreateTopic("t1", nil)
+
+	//More requests than message IDs, each one still get its own response
+	for i := 0; i < 1<<16+1000; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := client.PublishContext(ctx, "t1", []byte{byte(i)})
+		cancel()
+		if err != nil {
+			t.Fatal("Publish failed after", i, "requests:", err)
+		}
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	ch, err := client.Subscription("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Error("Close failed:", err)
+	}
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("Subscription channel should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("Subscription channel not closed")
+	}
+	if err := client.Publish("t1", "v1"); err != ErrClientClosed {
+		t.Error("Publish after close should fail:", err)
+	}
+	client.Close()
+}
+
+func TestClientContextDeadline(t *testing.T) {
+	//Broker never reply
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := NewClientContext(ctx, silent.LocalAddr().String()); err != context.DeadlineExceeded {
+		t.Error("Connect should fail by deadline:", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Connect not honor deadline:", time.Since(start))
+	}
+
+	_, conn := startBroker(t)
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	conn.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.PublishContext(ctx, "t1", []byte("v1")); err != context.DeadlineExceeded {
+		t.Error("Publish should fail by deadline:", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.ReadTopicContext(ctx, "t1"); err != context.Canceled {
+		t.Error("Read with cancelled context should fail:", err)
+	}
+}
+
+//Relay datagrams between client and broker, drop requests from client while drop > 0
+func lossyRelay(t *testing.T, broker *net.UDPAddr, drop *int32) *net.UDPConn {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	go func() {
+		var client *net.UDPAddr
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if from.String() == broker.String() {
+				relay.WriteToUDP(buf[:n], client)
+				continue
+			}
+			client = from
+			if atomic.AddInt32(drop, -1) >= 0 {
+				continue
+			}
+			relay.WriteToUDP(buf[:n], broker)
+		}
+	}()
+	return relay
+}
+
+func TestClientRetransmit(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+	var drop int32
+	relay := lossyRelay(t, conn.LocalAddr().(*net.UDPAddr), &drop)
+	defer relay.Close()
+
+	client := newClient(t, relay.LocalAddr().String())
+	client.SetRetransmit(50*time.Millisecond, 2)
+	client.CreateTopic("t1", nil)
+
+	//Lost request is retransmitted before deadline of ctx
+	atomic.StoreInt32(&drop, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := client.PublishContext(ctx, "t1", []byte("v1")); err != nil {
+		t.Error("Publish with lost request failed:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Lost request should be retransmitted:", elapsed)
+	}
+
+	//Registration fail after retransmissions, not wait for subscription ctx
+	atomic.StoreInt32(&drop, 100)
+	start = time.Now()
+	if _, err := client.SubscriptionContext(context.Background(), "t1"); err != ErrRequestTimeout {
+		t.Error("Subscribe should fail after retransmissions:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Subscribe wait too long:", elapsed)
+	}
+}
+
+func TestClientSubscriptionContextCancel(t *testing.T) {
+	broker, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := client.SubscriptionContext(ctx, "t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	client.Publish("t1", "v1")
+	if val := <-ch; string(val) != "v1" {
+		t.Error("Notification failed:", string(val))
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("Subscription channel should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscription channel not closed")
+	}
+	//Deregistration is sent before channel closed
+	if states := broker.DeliveryStates(); len(states) != 0 {
+		t.Error("Broker should remove subscription after cancel:", states)
+	}
+
+	//Subscribe again after cancel
+	ch, err = client.SubscriptionContext(context.Background(), "t1")
+	if err != nil {
+		t.Fatal("Subscribe again failed:", err)
+	}
+	client.Publish("t1", "v2")
+	if val := <-ch; string(val) != "v2" {
+		t.Error("Notification after subscribe again failed:", string(val))
+	}
+}
+
+//Record sockets opened by this process, by inode of socket fd in /proc/self/fd (Linux only)
+type socketCounter struct {
+	before map[string]bool
+	seen   map[string]bool
+}
+
+func openSockets() map[string]bool {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	ret := make(map[string]bool)
+	for _, fd := range fds {
+		if link, err := os.Readlink("/proc/self/fd/" + fd.Name()); err == nil && strings.HasPrefix(link, "socket:") {
+			ret[link] = true
+		}
+	}
+	return ret
+}
+
+func newSocketCounter() *socketCounter {
+	return &socketCounter{before: openSockets(), seen: make(map[string]bool)}
+}
+
+//Check sockets open now, it is not counted in benchmark time
+func (s *socketCounter) sample(b *testing.B) {
+	if s.before == nil {
+		return
+	}
+	b.StopTimer()
+	for link := range openSockets() {
+		if !s.before[link] {
+			s.seen[link] = true
+		}
+	}
+	b.StartTimer()
+}
+
+//Report new sockets per operation, skipped if /proc is not available
+func (s *socketCounter) report(b *testing.B) {
+	if s.before != nil {
+		b.ReportMetric(float64(len(s.seen))/float64(b.N), "sockets/op")
+	}
+}
+
+func BenchmarkClientPublish(b *testing.B) {
+	_, conn := startBroker(b)
+	defer conn.Close()
+
+	client := newClient(b, conn.LocalAddr().String())
+	client.CreateTopic("bench", nil)
+
+	sockets := newSocketCounter()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Publish("bench", "v"); err != nil {
+			b.Fatal("Publish failed:", err)
+		}
+		sockets.sample(b)
+	}
+	sockets.report(b)
+}
+
+//Same request as BenchmarkClientPublish, but dial new socket for each request as old client did
+func BenchmarkDialPerRequestPublish(b *testing.B) {
+	_, conn := startBroker(b)
+	defer conn.Close()
+
+	client := newClient(b, conn.LocalAddr().String())
+	client.CreateTopic("bench", nil)
+	client.Close()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 1500)
+	sockets := newSocketCounter()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			b.Fatal("Dial failed:", err)
+		}
+		if err := coap.Transmit(req, nil, *EncodeMessage(uint16(i), CMD_PUBLISH, "v", "bench")); err != nil {
+			b.Fatal("Send failed:", err)
+		}
+		req.SetReadDeadline(time.Now().Add(coap.ResponseTimeout))
+		n, err := req.Read(buf)
+		if err != nil {
+			b.Fatal("Publish failed:", err)
+		}
+		if rv, err := coap.ParseMessage(buf[:n]); err != nil || rv.Code != coap.Changed {
+			b.Fatal("Publish failed:", rv, err)
+		}
+		sockets.sample(b)
+		req.Close()
+	}
+	sockets.report(b)
+}
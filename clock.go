@@ -0,0 +1,17 @@
+package coapmq
+
+import "time"
+
+//Source of current time for topic lifetime, value Max-Age and history
+//Set Broker.Clock before serving to control time in test, nil for system time.
+type Clock interface {
+	Now() time.Time
+}
+
+//Current time of broker clock
+func (c *Broker) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
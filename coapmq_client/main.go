@@ -38,11 +38,12 @@ func main() {
 			toggleLogging(verbose)
 
 			fmt.Println("Connect to coapmq server:", serverAddr)
-			client := NewClient(serverAddr)
-			if client == nil {
-				fmt.Println("Cannot connect to server, please check your setting.")
+			client, err := NewClient(serverAddr)
+			if err != nil {
+				fmt.Println("Cannot connect to server, please check your setting:", err)
 				return
 			}
+			defer client.Close()
 			quit := false
 			scanner := bufio.NewScanner(os.Stdin)
 			printConsole()
@@ -66,7 +67,7 @@ func main() {
 				var err error
 				switch cmd {
 				case "C", "c": //CREATE TOPIC
-					err = client.CreateTopic(topic)
+					_, err = client.CreateTopic(topic, nil)
 					fmt.Println("CreateTopic topic:", topic, " ret=", err)
 				case "S", "s": //SUBSCRIPTION
 					ch, err := client.Subscription(topic)
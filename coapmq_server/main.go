@@ -1,13 +1,51 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"time"
 
 	. "github.com/kkdai/coapmq"
 )
 
 func main() {
+	dataDir := flag.String("d", "", "data directory to persist topics, keep in memory if empty")
+	flag.Parse()
+
 	log.Println("Server start....")
-	serv := NewBroker(1024)
-	serv.ListenAndServe(":5683")
+	var store Store
+	if *dataDir != "" {
+		fileStore, err := NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatal("Open data directory failed:", err)
+		}
+		defer fileStore.Close()
+		store = fileStore
+	}
+
+	serv, err := NewBroker(1024, store)
+	if err != nil {
+		log.Fatal("Create broker failed:", err)
+	}
+	serv.NotifyOnShutdown = true
+
+	//Shutdown gracefully on Ctrl+C, wait notifications at most 10 seconds
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		log.Println("Server shutdown....")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := serv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown err:", err)
+		}
+	}()
+
+	if err := serv.ListenAndServe(":5683"); err != ErrBrokerClosed {
+		log.Fatal(err)
+	}
 }
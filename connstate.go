@@ -0,0 +1,352 @@
+package coapmq
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Connection state of client to broker
+type ConnState int
+
+const (
+	//Broker respond last request
+	CONN_CONNECTED ConnState = iota
+	//Last request got no response, broker may be busy or packets are lost
+	CONN_DEGRADED
+	//Broker not respond CONN_LOST_FAILURES requests in a row
+	CONN_LOST
+)
+
+//Requests without response in a row before connection is lost
+const CONN_LOST_FAILURES = 3
+
+//Default interval of heart beat, it keep NAT binding of UDP port and detect broker lost
+const DEFAULT_HEART_BEAT = time.Minute
+
+//Default backoff to reconnect lost broker, it is doubled on each failure until the max
+const (
+	DEFAULT_RECONNECT_MIN = time.Second
+	DEFAULT_RECONNECT_MAX = time.Minute
+)
+
+//State changes buffered for StateChanges, oldest one is dropped when nobody read
+const connStateQueueSize = 16
+
+func (s ConnState) String() string {
+	switch s {
+	case CONN_CONNECTED:
+		return "connected"
+	case CONN_DEGRADED:
+		return "degraded"
+	case CONN_LOST:
+		return "lost"
+	}
+	return "unknown"
+}
+
+//Connection state change, Err is the request error caused it
+//Resynced event is sent for each subscription registered again after reconnect, it carry current value of Topic.
+//Err of resynced event means broker reject the subscription, its channel is closed.
+type ConnStateEvent struct {
+	State ConnState
+	Err   error
+	Time  time.Time
+
+	Resynced bool
+	Topic    string
+	Value    []byte
+}
+
+//Current connection state to broker
+func (c *Client) State() ConnState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+//Channel of connection state changes, it is closed by Close
+//Events are buffered, oldest event is dropped if channel is full.
+func (c *Client) StateChanges() <-chan ConnStateEvent {
+	return c.stateChan
+}
+
+//Set interval of heart beat, default DEFAULT_HEART_BEAT
+//Heart beat wait response within interval, so it also decide how fast broker lost is detected.
+func (c *Client) SetHeartBeat(interval time.Duration) {
+	c.stateLock.Lock()
+	c.heartBeatInterval = interval
+	c.stateLock.Unlock()
+
+	//Wake up heart beat to use new interval
+	select {
+	case c.heartBeatReset <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) getHeartBeat() time.Duration {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.heartBeatInterval
+}
+
+//Set time message ID is not reused, default EXCHANGE_LIFETIME (247 seconds)
+//It should be same as ExchangeLifetime of broker, request wait if more than 65536 requests are sent within it.
+func (c *Client) SetExchangeLifetime(lifetime time.Duration) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.exchangeLifetime = lifetime
+}
+
+func (c *Client) getExchangeLifetime() time.Duration {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.exchangeLifetime
+}
+
+//Set retransmission of confirmable request, default ACK_TIMEOUT (2 seconds) and MAX_RETRANSMIT (4)
+//Request without ctx deadline wait about ackTimeout * 2^(maxRetransmit+1) at most.
+func (c *Client) SetRetransmit(ackTimeout time.Duration, maxRetransmit int) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.ackTimeout, c.maxRetransmit = ackTimeout, maxRetransmit
+}
+
+func (c *Client) getRetransmit() (time.Duration, int) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.ackTimeout, c.maxRetransmit
+}
+
+//Set backoff to reconnect lost broker, default DEFAULT_RECONNECT_MIN to DEFAULT_RECONNECT_MAX
+func (c *Client) SetReconnectBackoff(min, max time.Duration) {
+	c.stateLock.Lock()
+	c.reconnectMin, c.reconnectMax = min, max
+	c.stateLock.Unlock()
+}
+
+//Next backoff to reconnect, double last one with a little jitter, so clients not retry at same time
+func (c *Client) nextBackoff(last time.Duration) time.Duration {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	next := last * 2
+	if next < c.reconnectMin {
+		next = c.reconnectMin
+	}
+	if next > c.reconnectMax {
+		next = c.reconnectMax
+	}
+	if next <= 0 {
+		next = DEFAULT_RECONNECT_MIN
+	}
+	return next + time.Duration(rand.Int63n(int64(next)/10+1))
+}
+
+//Subscriptions need register again when broker is back
+func (c *Client) needResync() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.resyncPending
+}
+
+//Keep broker instance ID from heart beat response, return true if it is changed
+//Broker restarted within heart beat interval is not lost, but it may lost all subscriptions.
+func (c *Client) brokerRestarted(instance []byte) bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if len(instance) == 0 {
+		//Broker not report its instance
+		return false
+	}
+	changed := c.brokerInstance != nil && !bytes.Equal(c.brokerInstance, instance)
+	c.brokerInstance = append([]byte(nil), instance...)
+	return changed
+}
+
+//Ask heart beat to reconnect and register all subscriptions again
+func (c *Client) requestResync() {
+	c.stateLock.Lock()
+	c.resyncPending = true
+	c.stateLock.Unlock()
+
+	select {
+	case c.heartBeatReset <- struct{}{}:
+	default:
+	}
+}
+
+//Update connection state by result of request, nil err means broker responded
+func (c *Client) requestResult(err error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.stateClosed {
+		return
+	}
+
+	state := CONN_CONNECTED
+	if err == nil {
+		c.failures = 0
+	} else {
+		c.failures++
+		state = CONN_DEGRADED
+		if c.failures >= CONN_LOST_FAILURES {
+			state = CONN_LOST
+		}
+	}
+	if state == c.state {
+		return
+	}
+	log.Println("Connection state:", c.state, "->", state, " err=", err)
+	c.state = state
+	if state == CONN_LOST {
+		//Broker may restart and lost subscriptions
+		c.resyncPending = true
+	}
+	c.pushEvent(ConnStateEvent{State: state, Err: err, Time: time.Now()})
+}
+
+//Send event to state channel, caller need hold the stateLock
+func (c *Client) pushEvent(ev ConnStateEvent) {
+	if c.stateClosed {
+		return
+	}
+	for {
+		select {
+		case c.stateChan <- ev:
+			return
+		default:
+		}
+		//Drop oldest event, reader care latest state most
+		select {
+		case <-c.stateChan:
+		default:
+		}
+	}
+}
+
+//Close state channel, no more state change after it
+func (c *Client) closeState() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if !c.stateClosed {
+		c.stateClosed = true
+		close(c.stateChan)
+	}
+}
+
+//Register all subscriptions again with same token, send resynced event for each of them
+//Return false if broker not respond, it is tried again on next reconnect.
+func (c *Client) resubscribe() bool {
+	c.lock.RLock()
+	subs := make(map[string]subConnection, len(c.subList))
+	for topic, sub := range c.subList {
+		subs[topic] = sub
+	}
+	c.lock.RUnlock()
+
+	for topic, sub := range subs {
+		cmd := NewCmd(CMD_SUBSCRIBE, topic, nil)
+		cmd.Accept = sub.accept
+		reqMsg := EncodeCmd(c.root(), c.getMsgID(), cmd)
+		reqMsg.Token = sub.token
+
+		ctx, cancel := context.WithTimeout(context.Background(), coap.ResponseTimeout)
+		ret, err := c.exchange(ctx, reqMsg)
+		if err == nil {
+			ret, err = c.fetchBlock2(ctx, reqMsg.Path(), nil, sub.accept, ret)
+		}
+		cancel()
+		if err != nil {
+			log.Println("Resync topic:", topic, " failed:", err)
+			return false
+		}
+
+		ev := ConnStateEvent{State: CONN_CONNECTED, Time: time.Now(), Resynced: true, Topic: topic}
+		if err := ErrorWrapper(ret.Code, nil); err != nil {
+			log.Println("Subscription on topic:", topic, " rejected after reconnect:", err)
+			c.removeSubscription(topic, sub)
+			ev.Err = err
+		} else {
+			//Broker may restart its sequence number
+			sub.fresh.reset(observeSeq(ret), time.Now())
+			ev.Value = ret.Payload
+		}
+		c.stateLock.Lock()
+		c.pushEvent(ev)
+		c.stateLock.Unlock()
+	}
+	return true
+}
+
+//Send heart beat in interval until client is closed, failure is reported by state change
+//After broker is lost, heart beat reconnect with backoff and register all subscriptions again.
+func (c *Client) heartBeat() {
+	defer c.wg.Done()
+	log.Println("Starting heart beat loop call")
+
+	var backoff time.Duration
+	timer := time.NewTimer(c.getHeartBeat())
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.heartBeatReset:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if c.needResync() {
+				backoff = c.nextBackoff(0)
+				timer.Reset(backoff)
+			} else {
+				timer.Reset(c.getHeartBeat())
+			}
+			continue
+		case <-timer.C:
+		}
+
+		resync := c.needResync()
+		interval := c.getHeartBeat()
+		timeout := interval
+		if timeout > coap.ResponseTimeout {
+			timeout = coap.ResponseTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ret, err := c.sendReq(ctx, CMD_HEARTBEAT, "", nil)
+		cancel()
+		if err != nil {
+			log.Println("Heart beat failed:", err)
+		} else {
+			log.Println("Send the heart beat")
+			if c.brokerRestarted(ret.Payload) {
+				log.Println("Broker restarted, register subscriptions again")
+				c.stateLock.Lock()
+				c.resyncPending = true
+				c.stateLock.Unlock()
+				resync = true
+			}
+			if resync && c.resubscribe() {
+				c.stateLock.Lock()
+				c.resyncPending = false
+				c.stateLock.Unlock()
+			}
+		}
+
+		if c.needResync() {
+			//Broker lost, reconnect with backoff
+			backoff = c.nextBackoff(backoff)
+			timer.Reset(backoff)
+		} else {
+			backoff = 0
+			timer.Reset(interval)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package coapmq_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/kkdai/coapmq"
+)
+
+func waitState(t *testing.T, ch <-chan ConnStateEvent, want ConnState) {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				t.Fatal("State channel closed, wait for:", want)
+			}
+			if ev.State == want {
+				return
+			}
+		case <-timeout:
+			t.Fatal("No state change to:", want)
+		}
+	}
+}
+
+func TestClientBrokerLost(t *testing.T) {
+	broker, conn := startBroker(t)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	client := newClient(t, addr.String())
+	client.SetHeartBeat(50 * time.Millisecond)
+	//Request to stopped broker fail after retransmissions
+	client.SetRetransmit(50*time.Millisecond, 1)
+	if client.State() != CONN_CONNECTED {
+		t.Error("Client should be connected:", client.State())
+	}
+
+	//Stop broker in the middle of session, client must survive it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	broker.Shutdown(ctx)
+	cancel()
+
+	states := client.StateChanges()
+	waitState(t, states, CONN_DEGRADED)
+	waitState(t, states, CONN_LOST)
+	if err := client.Publish("t1", "v1"); err == nil {
+		t.Error("Publish to stopped broker should fail")
+	}
+
+	//Broker back on same port
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer conn.Close()
+	go newBroker(t).Serve(context.Background(), conn)
+	waitState(t, states, CONN_CONNECTED)
+	if _, err := client.CreateTopic("t1", nil); err != nil {
+		t.Error("Request after broker back failed:", err)
+	}
+
+	//State channel is closed by Close, range end after buffered events
+	client.Close()
+	for range states {
+	}
+}
+
+//Restart broker on same address, topic t1 is created with value again but subscriptions are lost
+func restartBroker(t *testing.T, addr *net.UDPAddr, value string) *net.UDPConn {
+	broker := newBroker(t)
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	broker.ServeCOAP(nil, local, EncodeMessage(1, CMD_CREATE, "", "t1"))
+	broker.ServeCOAP(nil, local, EncodeMessage(2, CMD_PUBLISH, value, "t1"))
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	go broker.Serve(context.Background(), conn)
+	return conn
+}
+
+func TestClientReconnect(t *testing.T) {
+	//Broker lost is detected by heart beat, or by 5.03 notification when broker notify observers
+	for _, notify := range []bool{false, true} {
+		broker := newBroker(t)
+		broker.NotifyOnShutdown = notify
+		conn := serveBroker(t, broker)
+		addr := conn.LocalAddr().(*net.UDPAddr)
+
+		client := newClient(t, addr.String())
+		if !notify {
+			client.SetHeartBeat(50 * time.Millisecond)
+		}
+		client.SetReconnectBackoff(20*time.Millisecond, 200*time.Millisecond)
+		client.CreateTopic("t1", nil)
+		ch, err := client.SubscriptionBytes("t1")
+		if err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+
+		states := client.StateChanges()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		broker.Shutdown(ctx)
+		cancel()
+		if !notify {
+			waitState(t, states, CONN_LOST)
+		}
+
+		conn = restartBroker(t, addr, "v2")
+		timeout := time.After(5 * time.Second)
+	resync:
+		for {
+			select {
+			case ev := <-states:
+				if ev.Resynced {
+					if ev.Topic != "t1" || string(ev.Value) != "v2" || ev.Err != nil {
+						t.Error("Resynced event wrong:", ev)
+					}
+					break resync
+				}
+			case <-timeout:
+				t.Fatal("No resynced event, notify:", notify)
+			}
+		}
+
+		//Subscription is registered again on restarted broker
+		client.Publish("t1", "v3")
+		select {
+		case val := <-ch:
+			if string(val) != "v3" {
+				t.Error("Notification after reconnect failed:", string(val))
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("No notification after reconnect, notify:", notify)
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+func TestClientBrokerFastRestart(t *testing.T) {
+	broker := newBroker(t)
+	conn := serveBroker(t, broker)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	client := newClient(t, addr.String())
+	client.SetHeartBeat(200 * time.Millisecond)
+	client.CreateTopic("t1", nil)
+	ch, err := client.SubscriptionBytes("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	//Broker restart within one heart beat, client is never lost
+	states := client.StateChanges()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	broker.Shutdown(ctx)
+	cancel()
+	conn = restartBroker(t, addr, "v2")
+	defer conn.Close()
+
+	timeout := time.After(3 * time.Second)
+resync:
+	for {
+		select {
+		case ev := <-states:
+			if ev.State == CONN_LOST {
+				t.Error("Broker should not be lost:", ev)
+			}
+			if ev.Resynced {
+				if ev.Topic != "t1" || string(ev.Value) != "v2" || ev.Err != nil {
+					t.Error("Resynced event wrong:", ev)
+				}
+				break resync
+			}
+		case <-timeout:
+			t.Fatal("Broker restart not detected")
+		}
+	}
+
+	client.Publish("t1", "v3")
+	select {
+	case val := <-ch:
+		if string(val) != "v3" {
+			t.Error("Notification after restart failed:", string(val))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("No notification after restart")
+	}
+}
@@ -1,6 +1,11 @@
 package coapmq
 
-import "github.com/dustin/go-coap"
+import (
+	"errors"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
 
 type CMD_TYPE int
 
@@ -16,8 +21,47 @@ const (
 	CMD_REMOVE      CMD_TYPE = iota
 	//Propietary command to keep UDP connection alive
 	CMD_HEARTBEAT CMD_TYPE = iota
+	//Resource discovery on /.well-known/core (RFC 6690)
+	CMD_WELLKNOWN_CORE CMD_TYPE = iota
+)
+
+//URI path for pub/sub function set and proprietary heart beat
+const (
+	PUBSUB_PATH    = "ps"
+	HEARTBEAT_PATH = "hb"
+	WELLKNOWN_PATH = ".well-known/core"
 )
 
+//No Content-Format or Accept option in message, or topic has no "ct" attribute
+const CONTENT_FORMAT_NONE = -1
+
+//EXCHANGE_LIFETIME of RFC 7252 section 4.8.2 with default transmission parameters
+const exchangeLifetime = 247 * time.Second
+
+//Maximal UDP datagram size to read, same as go-coap
+const maxPacketSize = 1500
+
+//Returned by Broker.Serve after Shutdown
+var ErrBrokerClosed = errors.New("coapmq: Broker closed")
+
+//Returned by Client requests after Close
+var ErrClientClosed = errors.New("coapmq: Client closed")
+
+//Returned by Client requests when broker not respond after all retransmissions
+var ErrRequestTimeout = errors.New("coapmq: Request timeout")
+
+//Notification is newer regardless of sequence number if latest one is older than it (RFC 7641 section 3.4)
+const observeFreshTime = 128 * time.Second
+
+//Notifications queued for each subscription of client, oldest one is dropped when it is full
+const subscriptionQueueSize = 16
+
+//Link-format attributes of topic kept by broker on create
+var TOPIC_ATTRS = []string{"rt", "ct", "if", "title", "sz", TOPIC_LIFETIME_ATTR}
+
+//Resource type of pub/sub function set, for discovery on /.well-known/core
+const PUBSUB_RT = "core.ps"
+
 var ErrorCodeMappingTable map[coap.COAPCode]string = map[coap.COAPCode]string{
 	coap.Created:       "Created",
 	coap.Deleted:       "Deleted",
@@ -28,4 +72,9 @@ var ErrorCodeMappingTable map[coap.COAPCode]string = map[coap.COAPCode]string{
 	coap.NotFound:      "Not Found",
 	coap.Forbidden:     "Forbidden",
 	coap.NotAcceptable: "Not Acceptable",
+
+	coap.RequestEntityTooLarge: "Request Entity Too Large",
+	coap.UnsupportedMediaType:  "Unsupported Content-Format",
+	coap.InternalServerError:   "Internal Server Error",
+	coap.ServiceUnavailable:    "Service Unavailable",
 }
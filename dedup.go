@@ -0,0 +1,82 @@
+package coapmq
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Cache response of confirmable request by endpoint and message ID (RFC 7252 section 4.5)
+//Retransmitted request get the cached response, instead of processing again.
+type dedupCache struct {
+	lock    sync.Mutex
+	entries map[string]*dedupEntry
+	//Entries in arrival order, they expire in same order
+	order []*dedupEntry
+}
+
+type dedupEntry struct {
+	key string
+	//Retransmission carry same token, other token is a new request reusing message ID
+	token []byte
+	//Response of request, nil when still processing or no response
+	rv     *coap.Message
+	expire time.Time
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{entries: make(map[string]*dedupEntry)}
+}
+
+//Start processing request of key, return true and cached response if it is duplicate
+//Duplicate of request still processing get nil response, client will retransmit again.
+//Request with other token is new one, it replace the cached exchange of message ID.
+func (d *dedupCache) begin(key string, token []byte, lifetime time.Duration) (*coap.Message, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.expire(now)
+	if e, exist := d.entries[key]; exist && bytes.Equal(e.token, token) {
+		return e.rv, true
+	}
+	e := &dedupEntry{key: key, token: append([]byte(nil), token...), expire: now.Add(lifetime)}
+	d.entries[key] = e
+	d.order = append(d.order, e)
+	return nil, false
+}
+
+//Cache response of request, it is replayed for duplicates until expired
+func (d *dedupCache) finish(key string, token []byte, rv *coap.Message) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if e, exist := d.entries[key]; exist && bytes.Equal(e.token, token) {
+		e.rv = rv
+	}
+}
+
+//Remove expired entries, caller need hold the lock
+func (d *dedupCache) expire(now time.Time) {
+	n := 0
+	for _, e := range d.order {
+		if !now.After(e.expire) {
+			break
+		}
+		//Replaced entry is already removed from map
+		if d.entries[e.key] == e {
+			delete(d.entries, e.key)
+		}
+		n++
+	}
+	d.order = d.order[n:]
+}
+
+//Number of cached exchanges
+func (d *dedupCache) size() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.entries)
+}
@@ -0,0 +1,214 @@
+package coapmq
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Link-format attribute of topic lifetime in seconds, such as "<topic1>;lt=3600", "lt=0" keep it forever
+const TOPIC_LIFETIME_ATTR = "lt"
+
+//Check topic lifetime and value Max-Age when there is no request
+const expiryCheckInterval = time.Second
+
+//Last use of topic and expiry of its value
+type topicUsage struct {
+	//Zero for topic restored from store, lifetime start from first check
+	lastUsed time.Time
+	//Value is cleared at this time by Max-Age of publish, zero if never expire
+	valueExpire time.Time
+	//Value is cleared by Max-Age and not published again
+	valueExpired bool
+}
+
+//Lifetime of topic from its "lt" attribute or TopicLifetime, 0 is forever. caller need hold the lock
+func (c *Broker) topicLifetime(topic string) time.Duration {
+	if lt, err := strconv.Atoi(c.topicMapAttrs[topic][TOPIC_LIFETIME_ATTR]); err == nil {
+		return time.Duration(lt) * time.Second
+	}
+	return c.TopicLifetime
+}
+
+//Time topic expire if it is not used, false if it never expire. caller need hold the lock
+func (c *Broker) topicDeadline(topic string) (time.Time, bool) {
+	u, exist := c.topicUsage[topic]
+	lifetime := c.topicLifetime(topic)
+	if !exist || lifetime <= 0 {
+		return time.Time{}, false
+	}
+	return u.lastUsed.Add(lifetime), true
+}
+
+//Add usage of new or restored topic, caller need hold the lock
+func (c *Broker) addTopicUsage(topic string, now time.Time) {
+	c.topicUsage[topic] = &topicUsage{lastUsed: now}
+	if d, ok := c.topicDeadline(topic); ok {
+		c.scheduleExpiry(d)
+	}
+}
+
+//Restart lifetime of topic on create, publish, read and subscribe. caller need hold the lock
+func (c *Broker) touchTopic(topic string, now time.Time) {
+	if u, exist := c.topicUsage[topic]; exist {
+		u.lastUsed = now
+	}
+}
+
+//Keep Max-Age of published value, 0 for never expire. caller need hold the lock
+func (c *Broker) setValueMaxAge(topic string, now time.Time, maxAge time.Duration) {
+	u, exist := c.topicUsage[topic]
+	if !exist {
+		return
+	}
+	u.valueExpired = false
+	u.valueExpire = time.Time{}
+	if maxAge > 0 {
+		u.valueExpire = now.Add(maxAge)
+		c.scheduleExpiry(u.valueExpire)
+	}
+}
+
+//Remaining Max-Age of topic value, 0 if it never expire. caller need hold the lock
+func (c *Broker) valueMaxAge(topic string, now time.Time) time.Duration {
+	if u, exist := c.topicUsage[topic]; exist && !u.valueExpire.IsZero() {
+		return u.valueExpire.Sub(now)
+	}
+	return 0
+}
+
+//Check expiry at t, if it is earlier than next check. caller need hold the lock
+func (c *Broker) scheduleExpiry(t time.Time) {
+	if c.expiryScheduled && (c.nextExpiry.IsZero() || t.Before(c.nextExpiry)) {
+		c.nextExpiry = t
+	}
+}
+
+//Remove topics not used within lifetime and clear values after Max-Age, it is no-op before next expiry
+//Topic is kept while any child topic is kept. Observers of removed topic get 4.04, it end the observation.
+func (c *Broker) expireTopics(l *net.UDPConn) {
+	now := c.now()
+	c.lock.RLock()
+	due := !c.expiryScheduled || (!c.nextExpiry.IsZero() && !now.Before(c.nextExpiry))
+	c.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	c.lock.Lock()
+	var next time.Time
+	schedule := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	//Deadline of topic is the latest one of itself and all children
+	deadlines := make(map[string]time.Time)
+	forever := make(map[string]bool)
+	for topic, u := range c.topicUsage {
+		if u.lastUsed.IsZero() {
+			u.lastUsed = now
+		}
+		d, ok := c.topicDeadline(topic)
+		for t := topic; t != ""; t = ParentTopic(t) {
+			if !ok {
+				forever[t] = true
+			} else if d.After(deadlines[t]) {
+				deadlines[t] = d
+			}
+		}
+	}
+	var expired []string
+	for topic, d := range deadlines {
+		if forever[topic] {
+			continue
+		}
+		if now.Before(d) {
+			schedule(d)
+		} else {
+			expired = append(expired, topic)
+		}
+	}
+
+	//Parent is sorted before children, children are removed with it
+	sort.Strings(expired)
+	var msgs []*coap.Message
+	var addrs []*net.UDPAddr
+	for _, topic := range expired {
+		if _, exist := c.topicMapValue[topic]; !exist {
+			continue
+		}
+		log.Println("Topic lifetime expired, remove topic:", topic)
+		m, a := c.notFoundNotifications(topic)
+		msgs = append(msgs, m...)
+		addrs = append(addrs, a...)
+		c.removeTopicLocked(topic)
+	}
+
+	for topic, u := range c.topicUsage {
+		if u.valueExpire.IsZero() {
+			continue
+		}
+		if now.Before(u.valueExpire) {
+			schedule(u.valueExpire)
+			continue
+		}
+		log.Println("Value Max-Age expired, clear value of topic:", topic)
+		if err := c.store.SetValue(topic, nil); err != nil {
+			log.Println("Store set value failed:", err)
+		}
+		c.topicMapValue[topic] = nil
+		u.valueExpire = time.Time{}
+		u.valueExpired = true
+	}
+	c.nextExpiry = next
+	c.expiryScheduled = true
+	c.lock.Unlock()
+
+	if l == nil {
+		return
+	}
+	for k, m := range msgs {
+		//Get message ID without the lock, it may wait if too many messages to observer
+		m.MessageID = c.getMsgID(addrs[k])
+		if err := coap.Transmit(l, addrs[k], *m); err != nil {
+			log.Println("Error on notify topic removed to", addrs[k], " err:", err)
+		}
+	}
+}
+
+//Build 4.04 Not Found to observers of topic and its children, caller need hold the lock
+//Message ID is not set, caller get it after release the lock.
+func (c *Broker) notFoundNotifications(topic string) ([]*coap.Message, []*net.UDPAddr) {
+	var msgs []*coap.Message
+	var addrs []*net.UDPAddr
+	for t := range c.topicMapValue {
+		if t != topic && !strings.HasPrefix(t, topic+"/") {
+			continue
+		}
+		for _, client := range c.topicMapClients.subscribers(t) {
+			obs, exist := c.clientMapObserver[client]
+			if !exist {
+				continue
+			}
+			m := new(coap.Message)
+			m.Type = coap.NonConfirmable
+			m.Code = coap.NotFound
+			m.Token = obs.token
+			msgs = append(msgs, m)
+			addrs = append(addrs, obs.addr)
+		}
+	}
+	return msgs, addrs
+}
+
+//Max-Age option value in seconds, round up so value is not kept shorter
+func maxAgeSeconds(d time.Duration) uint32 {
+	return uint32((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,142 @@
+package coapmq_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+//Clock only move forward by Advance
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 22, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestTopicLifetime(t *testing.T) {
+	clock := newFakeClock()
+	broker := newBroker(t)
+	broker.Clock = clock
+	broker.TopicLifetime = time.Minute
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	client.CreateTopic("keep", map[string]string{"lt": "0"})
+	client.CreateTopic("p", nil)
+	client.CreateTopic("p/c", map[string]string{"lt": "600"})
+	client.CreateTopic("hist", nil)
+	ch, err := client.SubscriptionBytes("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	//Read and history read restart lifetime, even topic has no history
+	clock.Advance(50 * time.Second)
+	if _, err := client.ReadTopic("t1"); err != nil {
+		t.Fatal("Read topic failed:", err)
+	}
+	if _, err := client.ReadHistory("hist", time.Time{}, 0); err != nil {
+		t.Fatal("Read history failed:", err)
+	}
+	clock.Advance(50 * time.Second)
+	if _, err := client.ReadTopic("t1"); err != nil {
+		t.Error("Used topic should not expire:", err)
+	}
+	if _, err := client.ReadHistory("hist", time.Time{}, 0); err != nil {
+		t.Error("Topic only read by history should not expire:", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, err := client.ReadTopic("t1"); err == nil {
+		t.Error("Topic should be removed after lifetime")
+	}
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("Subscriber should get 4.04 instead of value")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Subscription not ended after topic expired")
+	}
+	if _, err := client.ReadTopic("keep"); err != nil {
+		t.Error("Topic with lt=0 should never expire:", err)
+	}
+	if _, err := client.ReadTopic("p"); err != nil {
+		t.Error("Parent topic should be kept with child:", err)
+	}
+
+	clock.Advance(10 * time.Minute)
+	if _, err := client.ReadTopic("p"); err == nil {
+		t.Error("Parent topic should be removed with child")
+	}
+	if data, err := client.DiscoveryTopic(""); err != nil || len(data) != 1 {
+		t.Error("Only topic keep should left:", data, err)
+	}
+}
+
+func TestValueMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	broker := newBroker(t)
+	broker.Clock = clock
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	var msgID uint16
+	serve := func(cmd *Cmd) *coap.Message {
+		msgID++
+		return broker.ServeCOAP(nil, client, wireMessage(t, EncodeCmd(PUBSUB_PATH, msgID, cmd)))
+	}
+	read := func() *coap.Message {
+		return serve(NewCmd(CMD_READ, "t1", nil))
+	}
+
+	serve(NewCmd(CMD_CREATE, "t1", nil))
+	pub := NewCmd(CMD_PUBLISH, "t1", []byte("v1"))
+	pub.MaxAge = 10 * time.Second
+	if rv := serve(pub); rv.Code != coap.Changed {
+		t.Fatal("Publish failed:", rv.Code)
+	}
+
+	clock.Advance(4 * time.Second)
+	rv := read()
+	if rv.Code != coap.Content || string(rv.Payload) != "v1" || rv.Option(coap.MaxAge) != uint32(6) {
+		t.Error("Read fresh value failed:", rv.Code, string(rv.Payload), rv.Option(coap.MaxAge))
+	}
+
+	//Value expired, topic is same as no content yet
+	clock.Advance(6 * time.Second)
+	if rv := read(); rv.Code != coap.Content || len(rv.Payload) != 0 || rv.Option(coap.MaxAge) != nil {
+		t.Error("Expired value should be empty:", rv.Code, string(rv.Payload))
+	}
+	broker.ExpiredValueNotFound = true
+	if rv := read(); rv.Code != coap.NotFound {
+		t.Error("Expired value should get 4.04:", rv.Code)
+	}
+
+	if rv := serve(NewCmd(CMD_PUBLISH, "t1", []byte("v2"))); rv.Code != coap.Changed {
+		t.Fatal("Publish failed:", rv.Code)
+	}
+	clock.Advance(time.Hour)
+	if rv := read(); rv.Code != coap.Content || string(rv.Payload) != "v2" {
+		t.Error("Value without Max-Age should never expire:", rv.Code, string(rv.Payload))
+	}
+}
@@ -0,0 +1,279 @@
+package coapmq
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//Log file name in data directory of FileStore
+const fileStoreLogName = "coapmq.log"
+
+//Compact log when it has more than this records and at least twice of live records
+const defaultCompactThreshold = 1024
+
+//Operation in FileStore log
+const (
+	logOpCreate = "create"
+	logOpRemove = "remove"
+	logOpValue  = "value"
+	logOpSub    = "sub"
+	logOpUnsub  = "unsub"
+)
+
+//One record in FileStore log, each record is a JSON line
+type logRecord struct {
+	Op      string            `json:"op"`
+	Topic   string            `json:"topic"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Value   []byte            `json:"value,omitempty"`
+	Address string            `json:"addr,omitempty"`
+	Token   []byte            `json:"token,omitempty"`
+	Seq     uint32            `json:"seq,omitempty"`
+}
+
+//Store all changes in an append-only log file under data directory
+//Log is replayed on open, and compacted to a snapshot when it grow too large.
+type FileStore struct {
+	//Compact log when record count more than this value and twice of live records
+	CompactThreshold int
+
+	lock    sync.Mutex
+	dir     string
+	file    *os.File
+	writer  *bufio.Writer
+	records int
+	//No compaction before record count more than this, it back off after compaction failed
+	compactAfter int
+	//Current state, replay from log
+	state *MemoryStore
+}
+
+//Open file store on data directory, create it if not exist
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := new(FileStore)
+	s.CompactThreshold = defaultCompactThreshold
+	s.dir = dir
+	s.state = NewMemoryStore()
+	size, torn, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	if torn {
+		//Drop torn record, or next record is appended to it and lost on next replay
+		if err := os.Truncate(s.logPath(), size); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	return s, nil
+}
+
+func (s *FileStore) logPath() string {
+	return filepath.Join(s.dir, fileStoreLogName)
+}
+
+//Replay log to rebuild current state
+//Return size of log to end of last complete record, and true if last record is torn by crash.
+func (s *FileStore) replay() (int64, bool, error) {
+	file, err := os.Open(s.logPath())
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println("Drop torn record at end of store log, len:", len(line))
+				return size, true, nil
+			}
+			return size, false, nil
+		}
+		if err != nil {
+			return size, false, err
+		}
+		size += int64(len(line))
+
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Println("Skip invalid record in store log:", err)
+			continue
+		}
+		s.apply(rec)
+		s.records++
+	}
+}
+
+func (s *FileStore) apply(rec logRecord) {
+	sub := SubscriptionRecord{Topic: rec.Topic, Address: rec.Address, Token: rec.Token, Seq: rec.Seq}
+	switch rec.Op {
+	case logOpCreate:
+		s.state.CreateTopic(rec.Topic, rec.Attrs)
+	case logOpRemove:
+		s.state.RemoveTopic(rec.Topic)
+	case logOpValue:
+		s.state.SetValue(rec.Topic, rec.Value)
+	case logOpSub:
+		s.state.AddSubscription(sub)
+	case logOpUnsub:
+		s.state.RemoveSubscription(sub)
+	}
+}
+
+//Append record to log and apply it to current state
+func (s *FileStore) append(rec logRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return errors.New("Store already closed")
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	s.apply(rec)
+	s.records++
+
+	//Record is already written, compaction failure is not failure of this write
+	if s.records > s.CompactThreshold && s.records > s.compactAfter {
+		topics, subs, _ := s.state.Load()
+		if s.records > 2*(len(topics)*2+len(subs)) {
+			if err := s.compact(topics, subs); err != nil {
+				log.Println("Store log compaction failed, retry after more records:", err)
+				s.compactAfter = s.records + s.CompactThreshold
+			}
+		}
+	}
+	return nil
+}
+
+//Rewrite log with only live records, caller need hold the lock
+func (s *FileStore) compact(topics []TopicRecord, subs []SubscriptionRecord) error {
+	tmpPath := s.logPath() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var recs []logRecord
+	for _, t := range topics {
+		recs = append(recs, logRecord{Op: logOpCreate, Topic: t.Topic, Attrs: t.Attrs})
+		if len(t.Value) > 0 {
+			recs = append(recs, logRecord{Op: logOpValue, Topic: t.Topic, Value: t.Value})
+		}
+	}
+	for _, sub := range subs {
+		recs = append(recs, logRecord{Op: logOpSub, Topic: sub.Topic, Address: sub.Address, Token: sub.Token, Seq: sub.Seq})
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, rec := range recs {
+		data, err := json.Marshal(rec)
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, s.logPath()); err != nil {
+		return err
+	}
+
+	//Switch to compacted log
+	s.file.Close()
+	file, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.records = len(recs)
+	log.Println("Store log compacted, records=", s.records)
+	return nil
+}
+
+func (s *FileStore) CreateTopic(topic string, attrs map[string]string) error {
+	return s.append(logRecord{Op: logOpCreate, Topic: topic, Attrs: attrs})
+}
+
+func (s *FileStore) RemoveTopic(topic string) error {
+	return s.append(logRecord{Op: logOpRemove, Topic: topic})
+}
+
+func (s *FileStore) SetValue(topic string, value []byte) error {
+	return s.append(logRecord{Op: logOpValue, Topic: topic, Value: value})
+}
+
+func (s *FileStore) AddSubscription(sub SubscriptionRecord) error {
+	return s.append(logRecord{Op: logOpSub, Topic: sub.Topic, Address: sub.Address, Token: sub.Token, Seq: sub.Seq})
+}
+
+func (s *FileStore) RemoveSubscription(sub SubscriptionRecord) error {
+	return s.append(logRecord{Op: logOpUnsub, Topic: sub.Topic, Address: sub.Address, Token: sub.Token})
+}
+
+func (s *FileStore) Load() ([]TopicRecord, []SubscriptionRecord, error) {
+	return s.state.Load()
+}
+
+//Flush and close log file
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
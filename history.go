@@ -0,0 +1,184 @@
+package coapmq
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Query parameters of history read, such as "ps/temp?since=2016-01-22T10:00:00Z&limit=50"
+const (
+	HISTORY_SINCE = "since"
+	HISTORY_LIMIT = "limit"
+)
+
+//One published value of topic, history is serialized to JSON array of it
+//Value is base64 string in JSON, so binary value is safe.
+type HistoryEntry struct {
+	Time  time.Time `json:"time"`
+	Value []byte    `json:"value"`
+}
+
+//Ring buffer of latest values of a topic, oldest one is overwritten when it is full
+type historyRing struct {
+	buf   []HistoryEntry
+	start int
+	n     int
+}
+
+func newHistoryRing(size int) *historyRing {
+	return &historyRing{buf: make([]HistoryEntry, size)}
+}
+
+func (r *historyRing) add(e HistoryEntry) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = e
+		r.n++
+		return
+	}
+	r.buf[r.start] = e
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+//Drop values published before t
+func (r *historyRing) expire(t time.Time) {
+	for r.n > 0 && r.buf[r.start].Time.Before(t) {
+		r.buf[r.start] = HistoryEntry{}
+		r.start = (r.start + 1) % len(r.buf)
+		r.n--
+	}
+}
+
+//Return values published at or after since, only the latest limit ones if limit > 0
+func (r *historyRing) since(since time.Time, limit int) []HistoryEntry {
+	ret := []HistoryEntry{}
+	for i := 0; i < r.n; i++ {
+		e := r.buf[(r.start+i)%len(r.buf)]
+		if !e.Time.Before(since) {
+			ret = append(ret, e)
+		}
+	}
+	if limit > 0 && len(ret) > limit {
+		ret = ret[len(ret)-limit:]
+	}
+	return ret
+}
+
+//Keep published value in history of topic, caller need hold the lock
+func (c *Broker) addHistory(topic string, value []byte, now time.Time) {
+	if c.HistorySize <= 0 {
+		return
+	}
+	r, exist := c.topicHistory[topic]
+	if !exist {
+		r = newHistoryRing(c.HistorySize)
+		c.topicHistory[topic] = r
+	}
+	if c.HistoryAge > 0 {
+		r.expire(now.Add(-c.HistoryAge))
+	}
+	r.add(HistoryEntry{Time: now, Value: value})
+}
+
+//Return values of topic published at or after since, only the latest limit ones if limit > 0
+//Values older than HistoryAge are dropped. History is empty if HistorySize is 0.
+func (c *Broker) History(topic string, since time.Time, limit int) ([]HistoryEntry, error) {
+	entries, res := c.readHistory(topic, since, limit)
+	if res != coap.Content {
+		return nil, errors.New(ErrorCodeMappingTable[res])
+	}
+	return entries, nil
+}
+
+func (c *Broker) readHistory(topic string, since time.Time, limit int) ([]HistoryEntry, coap.COAPCode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exist := c.topicMapValue[topic]; !exist {
+		return nil, coap.NotFound
+	}
+	c.touchTopic(topic, c.now())
+	r, exist := c.topicHistory[topic]
+	if !exist {
+		return []HistoryEntry{}, coap.Content
+	}
+	if c.HistoryAge > 0 {
+		r.expire(c.now().Add(-c.HistoryAge))
+	}
+	return r.since(since, limit), coap.Content
+}
+
+//History read is READ with "since" or "limit" query, response is JSON array
+func isHistoryQuery(query []string) bool {
+	for _, q := range query {
+		if strings.HasPrefix(q, HISTORY_SINCE+"=") || strings.HasPrefix(q, HISTORY_LIMIT+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+//Handle history read, return JSON array of values
+func (c *Broker) readHistoryQuery(topic string, query []string, accept int) ([]byte, int, coap.COAPCode) {
+	if !matchFormat(int(coap.AppJSON), accept) {
+		return nil, CONTENT_FORMAT_NONE, coap.NotAcceptable
+	}
+	since, limit, err := ParseHistoryQuery(query)
+	if err != nil {
+		return nil, CONTENT_FORMAT_NONE, coap.BadRequest
+	}
+	entries, res := c.readHistory(topic, since, limit)
+	if res != coap.Content {
+		return nil, CONTENT_FORMAT_NONE, res
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, CONTENT_FORMAT_NONE, coap.InternalServerError
+	}
+	return data, int(coap.AppJSON), res
+}
+
+//Parse "since" and "limit" of history query, since is RFC 3339 time or Unix seconds
+func ParseHistoryQuery(query []string) (time.Time, int, error) {
+	var since time.Time
+	limit := 0
+	for _, q := range query {
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case HISTORY_SINCE:
+			if sec, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				since = time.Unix(sec, 0)
+			} else if t, err := time.Parse(time.RFC3339Nano, kv[1]); err == nil {
+				since = t
+			} else {
+				return since, 0, errors.New("Invalid since: " + kv[1])
+			}
+		case HISTORY_LIMIT:
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 0 {
+				return since, 0, errors.New("Invalid limit: " + kv[1])
+			}
+			limit = n
+		}
+	}
+	return since, limit, nil
+}
+
+//Encode history query, zero since means all values kept by broker
+func EncodeHistoryQuery(since time.Time, limit int) []string {
+	query := []string{HISTORY_SINCE + "=0"}
+	if !since.IsZero() {
+		query[0] = HISTORY_SINCE + "=" + since.UTC().Format(time.RFC3339Nano)
+	}
+	if limit > 0 {
+		query = append(query, HISTORY_LIMIT+"="+strconv.Itoa(limit))
+	}
+	return query
+}
@@ -0,0 +1,134 @@
+package coapmq_test
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func historyValues(entries []HistoryEntry) []string {
+	var values []string
+	for _, e := range entries {
+		values = append(values, string(e.Value))
+	}
+	return values
+}
+
+func sameValues(entries []HistoryEntry, want ...string) bool {
+	values := historyValues(entries)
+	if len(values) != len(want) {
+		return false
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBrokerHistory(t *testing.T) {
+	broker := newBroker(t)
+	broker.HistorySize = 3
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+
+	var mid time.Time
+	for i := 1; i <= 5; i++ {
+		if i == 4 {
+			mid = time.Now()
+		}
+		broker.ServeCOAP(nil, client, EncodeMessage(uint16(i+1), CMD_PUBLISH, "v"+strconv.Itoa(i), "t1"))
+	}
+
+	if entries, err := broker.History("t1", time.Time{}, 0); err != nil || !sameValues(entries, "v3", "v4", "v5") {
+		t.Error("History should keep latest values:", historyValues(entries), err)
+	}
+	if entries, _ := broker.History("t1", time.Time{}, 2); !sameValues(entries, "v4", "v5") {
+		t.Error("History with limit failed:", historyValues(entries))
+	}
+	if entries, _ := broker.History("t1", mid, 0); !sameValues(entries, "v4", "v5") {
+		t.Error("History since time failed:", historyValues(entries))
+	}
+	if _, err := broker.History("none", time.Time{}, 0); err == nil {
+		t.Error("History of not exist topic should fail")
+	}
+
+	//History read by query, response is JSON array with time
+	read := func(msgID uint16, accept int, query ...string) *coap.Message {
+		m := EncodeMessage(msgID, CMD_READ, "", "t1")
+		for _, q := range query {
+			m.AddOption(coap.URIQuery, q)
+		}
+		if accept != CONTENT_FORMAT_NONE {
+			m.SetOption(coap.Accept, accept)
+		}
+		return broker.ServeCOAP(nil, client, wireMessage(t, m))
+	}
+	rv := read(10, CONTENT_FORMAT_NONE, "since="+strconv.FormatInt(mid.Unix()-1, 10), "limit=2")
+	var entries []HistoryEntry
+	if rv.Code != coap.Content || OptionFormat(rv, coap.ContentFormat) != int(coap.AppJSON) {
+		t.Fatal("Read history failed:", rv.Code)
+	}
+	if err := json.Unmarshal(rv.Payload, &entries); err != nil || !sameValues(entries, "v4", "v5") || entries[0].Time.IsZero() {
+		t.Error("History JSON wrong:", string(rv.Payload), err)
+	}
+	if rv := read(11, CONTENT_FORMAT_NONE, "limit=x"); rv.Code != coap.BadRequest {
+		t.Error("Invalid limit should get 4.00:", rv.Code)
+	}
+	if rv := read(12, int(coap.TextPlain), "limit=1"); rv.Code != coap.NotAcceptable {
+		t.Error("History only in JSON, should get 4.06:", rv.Code)
+	}
+	if rv := read(13, CONTENT_FORMAT_NONE); rv.Code != coap.Content || string(rv.Payload) != "v5" {
+		t.Error("Read without query should get latest value:", string(rv.Payload))
+	}
+}
+
+func TestBrokerHistoryAge(t *testing.T) {
+	clock := newFakeClock()
+	broker := newBroker(t)
+	broker.Clock = clock
+	broker.HistorySize = 10
+	broker.HistoryAge = time.Minute
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+	broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "old", "t1"))
+	clock.Advance(2 * time.Minute)
+	broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_PUBLISH, "new", "t1"))
+
+	if entries, _ := broker.History("t1", time.Time{}, 0); !sameValues(entries, "new") {
+		t.Error("Old value should be dropped from history:", historyValues(entries))
+	}
+}
+
+func TestClientReadHistory(t *testing.T) {
+	broker := newBroker(t)
+	broker.HistorySize = 50
+	//History JSON is larger than block, client get it by Block2 with same query
+	broker.BlockSize = 64
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("temp", nil)
+	for i := 1; i <= 10; i++ {
+		client.Publish("temp", strconv.Itoa(i))
+	}
+
+	entries, err := client.ReadHistory("temp", time.Time{}, 3)
+	if err != nil || !sameValues(entries, "8", "9", "10") {
+		t.Error("Read history failed:", historyValues(entries), err)
+	}
+	entries, err = client.ReadHistory("temp", entries[1].Time, 0)
+	if err != nil || !sameValues(entries, "9", "10") {
+		t.Error("Read history since failed:", historyValues(entries), err)
+	}
+	if _, err := client.ReadHistory("none", time.Time{}, 0); err == nil {
+		t.Error("Read history of not exist topic should fail")
+	}
+}
@@ -0,0 +1,221 @@
+package coapmq
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+//Link is one web link in CoRE Link Format (RFC 6690), ex: </ps/topic1>;rt="temperature";ct=0
+type Link struct {
+	URI    string
+	Params map[string]string
+}
+
+//Params always in quoted-string by RFC 6690 section 2, even value is only digits
+var quotedLinkParams = map[string]bool{"title": true, "rt": true, "if": true}
+
+//Escape '\' and '"' in quoted-string, parser take the char after '\' as it is
+var linkValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+//Encode link to link-format string, params are sorted by name
+func (l Link) String() string {
+	var keys []string
+	for k := range l.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := "<" + l.URI + ">"
+	for _, k := range keys {
+		v := l.Params[k]
+		switch {
+		case v == "":
+			ret += ";" + k
+		case isDigits(v) && !quotedLinkParams[k]:
+			ret += ";" + k + "=" + v
+		default:
+			ret += ";" + k + "=\"" + linkValueEscaper.Replace(v) + "\""
+		}
+	}
+	return ret
+}
+
+//Check if link match all query filter (RFC 6690 section 4.1), filter format is "name=value"
+//Value end with "*" is prefix match, "href" is match with link URI.
+func (l Link) Match(query []string) bool {
+	for _, q := range query {
+		if q == "" {
+			continue
+		}
+		name, value := q, ""
+		if idx := strings.Index(q, "="); idx >= 0 {
+			name, value = q[:idx], q[idx+1:]
+		}
+
+		if name == "href" {
+			if !matchLinkValue(l.URI, value) {
+				return false
+			}
+			continue
+		}
+
+		param, exist := l.Params[name]
+		if !exist {
+			return false
+		}
+		//rt, if could be space-separated list, match any of them
+		matched := false
+		for _, v := range strings.Fields(param) {
+			if matchLinkValue(v, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched && !matchLinkValue(param, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchLinkValue(v string, filter string) bool {
+	if strings.HasSuffix(filter, "*") {
+		return strings.HasPrefix(v, strings.TrimSuffix(filter, "*"))
+	}
+	return v == filter
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+//Encode links to link-format payload, links are separated by ","
+func EncodeLinkFormat(links []Link) string {
+	var ret []string
+	for _, l := range links {
+		ret = append(ret, l.String())
+	}
+	return strings.Join(ret, ",")
+}
+
+//Parse link-format payload (RFC 6690) to links
+func ParseLinkFormat(payload string) ([]Link, error) {
+	var links []Link
+	p := &linkParser{s: payload}
+
+	p.skipSpace()
+	for !p.eof() {
+		link, err := p.parseLink()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+
+		p.skipSpace()
+		if p.eof() {
+			break
+		}
+		if p.s[p.pos] != ',' {
+			return nil, errors.New("Invalid link-format, expect ','")
+		}
+		p.pos++
+		p.skipSpace()
+	}
+	return links, nil
+}
+
+type linkParser struct {
+	s   string
+	pos int
+}
+
+func (p *linkParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *linkParser) skipSpace() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\r' || p.s[p.pos] == '\n') {
+		p.pos++
+	}
+}
+
+func (p *linkParser) parseLink() (Link, error) {
+	link := Link{Params: make(map[string]string)}
+	if p.s[p.pos] != '<' {
+		return link, errors.New("Invalid link-format, expect '<'")
+	}
+	end := strings.IndexByte(p.s[p.pos:], '>')
+	if end < 0 {
+		return link, errors.New("Invalid link-format, expect '>'")
+	}
+	link.URI = p.s[p.pos+1 : p.pos+end]
+	p.pos += end + 1
+
+	for {
+		p.skipSpace()
+		if p.eof() || p.s[p.pos] != ';' {
+			return link, nil
+		}
+		p.pos++
+		p.skipSpace()
+
+		start := p.pos
+		for !p.eof() && strings.IndexByte("=;, \t", p.s[p.pos]) < 0 {
+			p.pos++
+		}
+		name := p.s[start:p.pos]
+		if name == "" {
+			return link, errors.New("Invalid link-format, empty param name")
+		}
+
+		p.skipSpace()
+		if p.eof() || p.s[p.pos] != '=' {
+			link.Params[name] = ""
+			continue
+		}
+		p.pos++
+		p.skipSpace()
+
+		value, err := p.parseValue()
+		if err != nil {
+			return link, err
+		}
+		link.Params[name] = value
+	}
+}
+
+func (p *linkParser) parseValue() (string, error) {
+	if p.eof() || p.s[p.pos] != '"' {
+		start := p.pos
+		for !p.eof() && strings.IndexByte(";, \t", p.s[p.pos]) < 0 {
+			p.pos++
+		}
+		return p.s[start:p.pos], nil
+	}
+
+	//Quoted string, could include ',' and ';'
+	p.pos++
+	var value []byte
+	for !p.eof() {
+		ch := p.s[p.pos]
+		p.pos++
+		switch ch {
+		case '\\':
+			if !p.eof() {
+				value = append(value, p.s[p.pos])
+				p.pos++
+			}
+		case '"':
+			return string(value), nil
+		default:
+			value = append(value, ch)
+		}
+	}
+	return "", errors.New("Invalid link-format, unterminated quoted string")
+}
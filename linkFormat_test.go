@@ -0,0 +1,85 @@
+package coapmq_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/kkdai/coapmq"
+)
+
+func TestParseLinkFormat(t *testing.T) {
+	links, err := ParseLinkFormat(`</ps/t1>;rt="temperature sensor";ct=0, </ps/t2>;title="a,b;c";obs,</ps/t3>`)
+	if err != nil {
+		t.Fatal("Parse failed:", err)
+	}
+	if len(links) != 3 {
+		t.Fatal("Parse link count failed:", links)
+	}
+	if links[0].URI != "/ps/t1" || links[0].Params["rt"] != "temperature sensor" || links[0].Params["ct"] != "0" {
+		t.Error("Parse first link failed:", links[0])
+	}
+	if links[1].Params["title"] != "a,b;c" {
+		t.Error("Parse quoted param failed:", links[1])
+	}
+	if _, exist := links[1].Params["obs"]; !exist {
+		t.Error("Parse param without value failed:", links[1])
+	}
+	if links[2].URI != "/ps/t3" || len(links[2].Params) != 0 {
+		t.Error("Parse link without param failed:", links[2])
+	}
+
+	if _, err := ParseLinkFormat(`</ps/t1;rt=1`); err == nil {
+		t.Error("Invalid link-format should fail")
+	}
+}
+
+func TestLinkFormatRoundTrip(t *testing.T) {
+	links := []Link{
+		{URI: "/ps/t1", Params: map[string]string{"rt": "temperature", "ct": "0"}},
+		{URI: "/ps/t2", Params: map[string]string{"title": `say "hi"`}},
+	}
+	payload := EncodeLinkFormat(links)
+	if payload != `</ps/t1>;ct=0;rt="temperature",</ps/t2>;title="say \"hi\""` {
+		t.Error("Encode failed:", payload)
+	}
+
+	ret, err := ParseLinkFormat(payload)
+	if err != nil || len(ret) != 2 || ret[1].Params["title"] != `say "hi"` || ret[0].Params["rt"] != "temperature" {
+		t.Error("Round trip failed:", ret, err)
+	}
+
+	//Backslash is escaped, title and rt are quoted even only digits
+	links = []Link{{URI: "/ps/t3", Params: map[string]string{"title": "2016", "rt": "42", "sz": "10", "if": `C:\dir\"x"`}}}
+	payload = EncodeLinkFormat(links)
+	if payload != `</ps/t3>;if="C:\\dir\\\"x\"";rt="42";sz=10;title="2016"` {
+		t.Error("Encode failed:", payload)
+	}
+	ret, err = ParseLinkFormat(payload)
+	if err != nil || len(ret) != 1 || !reflect.DeepEqual(ret[0], links[0]) {
+		t.Error("Round trip failed:", ret, err)
+	}
+}
+
+func TestLinkMatch(t *testing.T) {
+	link := Link{URI: "/ps/t1", Params: map[string]string{"rt": "temperature sensor", "ct": "0"}}
+	cases := []struct {
+		query []string
+		match bool
+	}{
+		{nil, true},
+		{[]string{"rt=temperature"}, true},
+		{[]string{"rt=sensor", "ct=0"}, true},
+		{[]string{"rt=temp*"}, true},
+		{[]string{"rt=humidity"}, false},
+		{[]string{"ct=40"}, false},
+		{[]string{"if=core.ps"}, false},
+		{[]string{"href=/ps/t1"}, true},
+		{[]string{"href=/ps/*"}, true},
+		{[]string{"href=/ps/t2"}, false},
+	}
+	for _, c := range cases {
+		if link.Match(c.query) != c.match {
+			t.Error("Match failed on query:", c.query)
+		}
+	}
+}
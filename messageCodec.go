@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-coap"
 )
@@ -11,7 +12,19 @@ import (
 type Cmd struct {
 	Type  CMD_TYPE
 	Topic string
-	Msg   string
+	//Payload as string, use Payload for binary data
+	Msg string
+	//Raw payload, could be any binary such as CBOR or protobuf
+	Payload []byte
+	//Query filter for discover, each one is "name=value"
+	Query []string
+	//Content-Format of payload and Accept of response, CONTENT_FORMAT_NONE if not set
+	ContentFormat int
+	Accept        int
+	//Link-format attributes of topic to create, such as "rt" and "ct"
+	Attrs map[string]string
+	//Max-Age of published value, 0 for never expire
+	MaxAge time.Duration
 }
 
 func GetMsgCmdCode(cmd CMD_TYPE) coap.COAPCode {
@@ -32,6 +45,8 @@ func GetMsgCmdCode(cmd CMD_TYPE) coap.COAPCode {
 		code = coap.GET
 	case CMD_REMOVE:
 		code = coap.DELETE
+	case CMD_WELLKNOWN_CORE:
+		code = coap.GET
 	case CMD_HEARTBEAT:
 		code = coap.Content
 	}
@@ -42,36 +57,150 @@ func GetMsgCmdCode(cmd CMD_TYPE) coap.COAPCode {
 //Refer to coapmq RFC:  https://datatracker.ietf.org/doc/draft-koster-core-coap-pubsub
 //URI Template:  /{+ps/}{topic}{/topic*}
 func EncodeCmdsToPath(cmd CMD_TYPE, topic string) []string {
+	return EncodeCmdsToRootPath(PUBSUB_PATH, cmd, topic)
+}
+
+//Same as EncodeCmdsToPath, but pub/sub function set is located at root (ex: "ps" or "api/ps")
+func EncodeCmdsToRootPath(root string, cmd CMD_TYPE, topic string) []string {
 	var pathURI []string
 	// cmd URI: {+ps}/{*topic}
-	if cmd == CMD_HEARTBEAT {
-		pathURI = append(pathURI, "hb")
-	} else {
-		pathURI = append(pathURI, "ps")
+	switch cmd {
+	case CMD_HEARTBEAT:
+		pathURI = append(pathURI, HEARTBEAT_PATH)
+	case CMD_WELLKNOWN_CORE:
+		return strings.Split(WELLKNOWN_PATH, "/")
+	default:
+		pathURI = append(pathURI, strings.Split(strings.Trim(root, "/"), "/")...)
 	}
 
-	pathURI = append(pathURI, topic)
-
+	//Discover is GET on pub/sub root, query filter is in URI-Query option
 	if cmd == CMD_DISCOVER {
-		//TODO add query filter
+		return pathURI
+	}
+	//Create is POST on parent topic, new topic is in link-format payload
+	if cmd == CMD_CREATE {
+		if parent := ParentTopic(strings.Trim(topic, "/")); parent != "" {
+			pathURI = append(pathURI, SplitTopic(parent)...)
+		}
+		return pathURI
 	}
+
+	//Topic could be hierarchical, ex: "building1/floor2/temp"
+	pathURI = append(pathURI, SplitTopic(topic)...)
 	return pathURI
 }
 
+//Split hierarchical topic "a/b/c" to path segments
+func SplitTopic(topic string) []string {
+	return strings.Split(strings.Trim(topic, "/"), "/")
+}
+
+//Topic must not have empty segment (ex: "a//b") or wildcard
+func ValidTopic(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	for _, seg := range strings.Split(topic, "/") {
+		if seg == "" || strings.ContainsAny(seg, WILDCARD_SINGLE+WILDCARD_MULTI) {
+			return false
+		}
+	}
+	return true
+}
+
+//Return parent of hierarchical topic, "a/b/c" -> "a/b", top level topic return ""
+func ParentTopic(topic string) string {
+	if idx := strings.LastIndex(topic, "/"); idx >= 0 {
+		return topic[:idx]
+	}
+	return ""
+}
+
+//Return last level of hierarchical topic, "a/b/c" -> "c"
+func TopicName(topic string) string {
+	topic = strings.Trim(topic, "/")
+	return topic[strings.LastIndex(topic, "/")+1:]
+}
+
+//Join path segments to hierarchical topic "a/b/c"
+func JoinTopic(segments []string) string {
+	return strings.Join(segments, "/")
+}
+
+//Split query filter such as "rt=temperature&ct=0" to URI-Query list
+func EncodeQuery(queryFilter string) []string {
+	var query []string
+	for _, q := range strings.Split(strings.TrimPrefix(queryFilter, "?"), "&") {
+		if q != "" {
+			query = append(query, q)
+		}
+	}
+	return query
+}
+
 func EncodeMessage(msgID uint16, cmd CMD_TYPE, msg string, topic string) *coap.Message {
+	return EncodeRootMessage(PUBSUB_PATH, msgID, cmd, msg, topic)
+}
+
+//Same as EncodeMessage, but send to pub/sub function set located at root
+func EncodeRootMessage(root string, msgID uint16, cmd CMD_TYPE, msg string, topic string) *coap.Message {
+	return EncodeRootMessageBytes(root, msgID, cmd, []byte(msg), topic)
+}
+
+//Same as EncodeRootMessage, payload is binary
+func EncodeRootMessageBytes(root string, msgID uint16, cmd CMD_TYPE, payload []byte, topic string) *coap.Message {
+	c := NewCmd(cmd, topic, payload)
+	//For discover, topic is the query filter
+	if cmd == CMD_DISCOVER || cmd == CMD_WELLKNOWN_CORE {
+		c.Topic = ""
+		c.Query = EncodeQuery(topic)
+	}
+	return EncodeCmd(root, msgID, c)
+}
+
+//Create command without Content-Format and Accept
+func NewCmd(cmd CMD_TYPE, topic string, payload []byte) *Cmd {
+	return &Cmd{Type: cmd, Topic: topic, Msg: string(payload), Payload: payload, ContentFormat: CONTENT_FORMAT_NONE, Accept: CONTENT_FORMAT_NONE}
+}
+
+//Encode command to message send to pub/sub function set located at root
+func EncodeCmd(root string, msgID uint16, cmd *Cmd) *coap.Message {
 	m := new(coap.Message)
 	m.Type = coap.Confirmable
-	m.Code = GetMsgCmdCode(cmd)
+	m.Code = GetMsgCmdCode(cmd.Type)
 	m.MessageID = msgID
 
-	m.Payload = []byte(msg)
-	m.SetPath(EncodeCmdsToPath(cmd, topic))
+	payload := cmd.Payload
+	format := cmd.ContentFormat
+	if payload == nil {
+		payload = []byte(cmd.Msg)
+	}
+	//Create with link-format of new topic such as "<topic1>;ct=50", if payload not given
+	if cmd.Type == CMD_CREATE && len(payload) == 0 {
+		link := Link{URI: TopicName(cmd.Topic), Params: cmd.Attrs}
+		payload = []byte(link.String())
+		format = int(coap.AppLinkFormat)
+	}
+	if len(payload) > 0 {
+		m.Payload = payload
+	}
+	m.SetPath(EncodeCmdsToRootPath(root, cmd.Type, cmd.Topic))
+	for _, q := range cmd.Query {
+		m.AddOption(coap.URIQuery, q)
+	}
 
-	//m.SetOption(coap.ContentFormat, coap.TextPlain)
-	m.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+	if format != CONTENT_FORMAT_NONE {
+		m.SetOption(coap.ContentFormat, format)
+	}
+	if cmd.Accept != CONTENT_FORMAT_NONE {
+		m.SetOption(coap.Accept, cmd.Accept)
+	}
+	if cmd.MaxAge > 0 {
+		m.SetOption(coap.MaxAge, maxAgeSeconds(cmd.MaxAge))
+	}
 
 	//specific handle for Observe (Refer RFC 7461)
-	switch cmd {
+	switch cmd.Type {
 	case CMD_SUBSCRIBE:
 		m.SetOption(coap.Observe, 0)
 	case CMD_UNSUBSCRIBE:
@@ -83,16 +212,25 @@ func EncodeMessage(msgID uint16, cmd CMD_TYPE, msg string, topic string) *coap.M
 //Parse receive message to Coapmq.Cmd to get command and topic
 func MessageDecode(m *coap.Message) (*Cmd, error) {
 	path := m.Path()
-	log.Println("msg:", path, " cmd=", path[0])
 	if len(path) == 0 {
 		//cmd is not valid.
 		return nil, errors.New("Invalid parameter")
 	}
+	log.Println("msg:", path, " cmd=", path[0])
 
 	c := new(Cmd)
 	c.Type = CMD_INVALID
+	c.ContentFormat = OptionFormat(m, coap.ContentFormat)
+	c.Accept = OptionFormat(m, coap.Accept)
+	if strings.Join(path, "/") == WELLKNOWN_PATH {
+		if m.Code == coap.GET {
+			c.Type = CMD_WELLKNOWN_CORE
+			c.Query = decodeQuery(m)
+		}
+		return c, nil
+	}
 	if len(path) > 1 {
-		c.Topic = path[1]
+		c.Topic = JoinTopic(path[1:])
 	}
 
 	switch m.Code {
@@ -107,18 +245,33 @@ func MessageDecode(m *coap.Message) (*Cmd, error) {
 			}
 		} else {
 			if strings.HasPrefix(c.Topic, "?") {
-				//it is discover
+				//it is discover, query filter in path
 				c.Type = CMD_DISCOVER
+				c.Query = EncodeQuery(c.Topic)
+				c.Topic = ""
 			} else if c.Topic != "" {
 				c.Type = CMD_READ
+				//History read has "since" and "limit" query
+				c.Query = decodeQuery(m)
+			} else if path[0] == PUBSUB_PATH {
+				//GET on pub/sub root is discover
+				c.Type = CMD_DISCOVER
+				c.Query = decodeQuery(m)
 			} else {
 				//cmd not valid
 			}
 		}
 	case coap.POST:
 		c.Type = CMD_CREATE
+		if err := decodeCreate(c, m); err != nil {
+			return nil, err
+		}
 	case coap.PUT:
 		c.Type = CMD_PUBLISH
+		//Max-Age 0 is same as no Max-Age, value never expire
+		if v, ok := m.Option(coap.MaxAge).(uint32); ok {
+			c.MaxAge = time.Duration(v) * time.Second
+		}
 	case coap.DELETE:
 		c.Type = CMD_REMOVE
 	case coap.Content:
@@ -126,7 +279,55 @@ func MessageDecode(m *coap.Message) (*Cmd, error) {
 	}
 
 	if c.Type != CMD_INVALID {
+		c.Payload = m.Payload
 		c.Msg = string(m.Payload)
 	}
 	return c, nil
 }
+
+//Create is POST of link-format "<topic1>;ct=50" on parent topic, get new topic and its attributes
+//Legacy create without payload is POST on the new topic itself.
+func decodeCreate(c *Cmd, m *coap.Message) error {
+	if len(m.Payload) == 0 || (c.ContentFormat != CONTENT_FORMAT_NONE && c.ContentFormat != int(coap.AppLinkFormat)) {
+		return nil
+	}
+
+	links, err := ParseLinkFormat(string(m.Payload))
+	if err != nil {
+		return err
+	}
+	if len(links) != 1 {
+		return errors.New("Create need exactly one link")
+	}
+
+	name := strings.Trim(links[0].URI, "/")
+	if c.Topic != "" {
+		name = JoinTopic([]string{c.Topic, name})
+	}
+	c.Topic = name
+	c.Attrs = links[0].Params
+	return nil
+}
+
+//Return value of Content-Format or Accept option, CONTENT_FORMAT_NONE if not found
+func OptionFormat(m *coap.Message, id coap.OptionID) int {
+	switch v := m.Option(id).(type) {
+	case coap.MediaType:
+		return int(v)
+	case uint32:
+		return int(v)
+	case int:
+		return v
+	}
+	return CONTENT_FORMAT_NONE
+}
+
+func decodeQuery(m *coap.Message) []string {
+	var query []string
+	for _, q := range m.Options(coap.URIQuery) {
+		if v, ok := q.(string); ok {
+			query = append(query, v)
+		}
+	}
+	return query
+}
@@ -0,0 +1,87 @@
+package coapmq_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func TestHierarchicalTopicCodec(t *testing.T) {
+	m := EncodeMessage(1, CMD_READ, "", "building1/floor2/temp")
+	if path := m.Path(); !reflect.DeepEqual(path, []string{"ps", "building1", "floor2", "temp"}) {
+		t.Error("Encode hierarchical topic failed:", path)
+	}
+
+	cmd, err := MessageDecode(m)
+	if err != nil || cmd.Type != CMD_READ || cmd.Topic != "building1/floor2/temp" {
+		t.Error("Decode hierarchical topic failed:", cmd, err)
+	}
+
+	topic := JoinTopic([]string{"building1", "floor2", "temp"})
+	if topic != "building1/floor2/temp" || !reflect.DeepEqual(SplitTopic("/"+topic), []string{"building1", "floor2", "temp"}) {
+		t.Error("Join/Split topic failed:", topic)
+	}
+	if ParentTopic(topic) != "building1/floor2" || ParentTopic("building1") != "" {
+		t.Error("Parent topic failed")
+	}
+	if ValidTopic("a//b") || ValidTopic("") || !ValidTopic("a/b") {
+		t.Error("Valid topic failed")
+	}
+}
+
+func TestBinaryPayloadCodec(t *testing.T) {
+	data := []byte{0x00, 0x01, 0xff, 0x00, 'a'}
+	m := EncodeRootMessageBytes("ps", 1, CMD_PUBLISH, data, "t1")
+	if !bytes.Equal(m.Payload, data) {
+		t.Error("Encode binary payload failed:", m.Payload)
+	}
+
+	cmd, err := MessageDecode(m)
+	if err != nil || cmd.Type != CMD_PUBLISH || !bytes.Equal(cmd.Payload, data) || cmd.Msg != string(data) {
+		t.Error("Decode binary payload failed:", cmd, err)
+	}
+}
+
+func TestContentFormatCodec(t *testing.T) {
+	m := EncodeMessage(1, CMD_PUBLISH, "21", "t1")
+	if m.Option(coap.ContentFormat) != nil {
+		t.Error("Content-Format should not set by default:", m.Option(coap.ContentFormat))
+	}
+	cmd, _ := MessageDecode(m)
+	if cmd.ContentFormat != CONTENT_FORMAT_NONE || cmd.Accept != CONTENT_FORMAT_NONE {
+		t.Error("Decode message without format failed:", cmd)
+	}
+
+	cmd = NewCmd(CMD_READ, "t1", nil)
+	cmd.ContentFormat = int(coap.AppJSON)
+	cmd.Accept = 60
+	data, _ := EncodeCmd("ps", 1, cmd).MarshalBinary()
+	wire, _ := coap.ParseMessage(data)
+	decoded, err := MessageDecode(&wire)
+	if err != nil || decoded.Type != CMD_READ || decoded.ContentFormat != int(coap.AppJSON) || decoded.Accept != 60 {
+		t.Error("Decode Content-Format and Accept failed:", decoded, err)
+	}
+}
+
+func TestCreateCodec(t *testing.T) {
+	cmd := NewCmd(CMD_CREATE, "sensors/temp", nil)
+	cmd.Attrs = map[string]string{"ct": "50", "rt": "temperature"}
+	m := EncodeCmd("ps", 1, cmd)
+	if path := m.Path(); !reflect.DeepEqual(path, []string{"ps", "sensors"}) {
+		t.Error("Create should POST on parent topic:", path)
+	}
+	if string(m.Payload) != `<temp>;ct=50;rt="temperature"` || m.Option(coap.ContentFormat) != int(coap.AppLinkFormat) {
+		t.Error("Create should carry link-format of new topic:", string(m.Payload), m.Option(coap.ContentFormat))
+	}
+
+	decoded, err := MessageDecode(m)
+	if err != nil || decoded.Type != CMD_CREATE || decoded.Topic != "sensors/temp" || !reflect.DeepEqual(decoded.Attrs, cmd.Attrs) {
+		t.Error("Decode create failed:", decoded, err)
+	}
+	if m := EncodeMessage(1, CMD_CREATE, "", "t1"); !reflect.DeepEqual(m.Path(), []string{"ps"}) || string(m.Payload) != "<t1>" {
+		t.Error("Create top level topic failed:", m.Path(), string(m.Payload))
+	}
+}
@@ -0,0 +1,114 @@
+package coapmq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+//Token length in bytes, maximal length of RFC 7252 for best randomness
+const TOKEN_LENGTH = 8
+
+//Prune idle endpoints when generator track more than this count
+const msgIDPruneThreshold = 1024
+
+//Message IDs are tracked in blocks, block is reused only after all IDs in it are out of exchange lifetime
+const (
+	msgIDBlockBits = 10
+	msgIDBlocks    = 1 << (16 - msgIDBlockBits)
+)
+
+//Generate message ID for each destination endpoint (RFC 7252 section 4.4)
+//Each endpoint start from a random ID and increase by one, it wrap around after 65535.
+//ID is not reused within exchange lifetime, Next wait if all IDs are used in it.
+//It is safe to be called from multiple goroutines.
+type MessageIDGenerator struct {
+	lock      sync.Mutex
+	endpoints map[string]*msgIDState
+}
+
+type msgIDState struct {
+	next uint16
+	used time.Time
+	//Last time an ID of each block is used
+	blockUsed [msgIDBlocks]time.Time
+}
+
+func NewMessageIDGenerator() *MessageIDGenerator {
+	return &MessageIDGenerator{endpoints: make(map[string]*msgIDState)}
+}
+
+//Return next message ID to endpoint, such as "192.168.1.2:5683"
+//It is not reused within EXCHANGE_LIFETIME.
+func (g *MessageIDGenerator) Next(endpoint string) uint16 {
+	return g.NextWithin(endpoint, exchangeLifetime)
+}
+
+//Same as Next, ID is not reused within lifetime
+//It wait for older IDs expire, if more than 65536 IDs are used in lifetime.
+func (g *MessageIDGenerator) NextWithin(endpoint string, lifetime time.Duration) uint16 {
+	for {
+		id, wait := g.next(endpoint, lifetime)
+		if wait <= 0 {
+			return id
+		}
+		time.Sleep(wait)
+	}
+}
+
+//Return next ID, or time to wait if block of next ID is still in lifetime
+func (g *MessageIDGenerator) next(endpoint string, lifetime time.Duration) (uint16, time.Duration) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	st, exist := g.endpoints[endpoint]
+	if !exist {
+		if len(g.endpoints) >= msgIDPruneThreshold {
+			g.prune(now, lifetime)
+		}
+		st = &msgIDState{next: randomUint16()}
+		g.endpoints[endpoint] = st
+	}
+	id := st.next
+	block := id >> msgIDBlockBits
+	//Enter a block again after wrap around
+	if used := st.blockUsed[block]; id&(1<<msgIDBlockBits-1) == 0 && !used.IsZero() {
+		if wait := used.Add(lifetime).Sub(now); wait > 0 {
+			return 0, wait
+		}
+	}
+	st.next++
+	st.used = now
+	st.blockUsed[block] = now
+	return id, 0
+}
+
+//Remove endpoints idle more than lifetime, their message IDs are safe to reuse
+func (g *MessageIDGenerator) prune(now time.Time, lifetime time.Duration) {
+	for endpoint, st := range g.endpoints {
+		if now.Sub(st.used) > lifetime {
+			delete(g.endpoints, endpoint)
+		}
+	}
+}
+
+//Generate crypto random token to match response and notification with request (RFC 7252 section 5.3.1)
+func NewToken() []byte {
+	token := make([]byte, TOKEN_LENGTH)
+	if _, err := rand.Read(token); err != nil {
+		//Should not happen, still better than no token
+		binary.BigEndian.PutUint64(token, uint64(mrand.Int63()))
+	}
+	return token
+}
+
+func randomUint16() uint16 {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return uint16(mrand.Intn(1 << 16))
+	}
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,108 @@
+package coapmq_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/kkdai/coapmq"
+)
+
+func TestMessageIDWraparound(t *testing.T) {
+	const lifetime = 300 * time.Millisecond
+	gen := NewMessageIDGenerator()
+	start := time.Now()
+	first := gen.NextWithin("127.0.0.1:5683", lifetime)
+	prev := first
+	seen := map[uint16]bool{first: true}
+	wrapped := 0
+	for i := 1; i < 1<<16; i++ {
+		id := gen.NextWithin("127.0.0.1:5683", lifetime)
+		if id != prev+1 {
+			t.Fatal("Message ID not in sequence:", prev, id)
+		}
+		if id < prev {
+			wrapped++
+		}
+		if seen[id] {
+			t.Fatal("Message ID reused before wraparound:", id)
+		}
+		seen[id] = true
+		prev = id
+	}
+	if first != 0 && wrapped != 1 {
+		t.Error("Message ID should wrap around once, got:", wrapped)
+	}
+
+	//All IDs are used, first one is reused only after lifetime
+	if id := gen.NextWithin("127.0.0.1:5683", lifetime); id != first {
+		t.Error("Message ID should start over after 65536 messages:", first, id)
+	}
+	if elapsed := time.Since(start); elapsed < lifetime {
+		t.Error("Message ID reused within exchange lifetime:", elapsed)
+	}
+}
+
+func TestMessageIDPerEndpoint(t *testing.T) {
+	gen := NewMessageIDGenerator()
+	a1 := gen.Next("[::1]:5683")
+	b1 := gen.Next("192.168.1.2:5683")
+	if a2 := gen.Next("[::1]:5683"); a2 != a1+1 {
+		t.Error("Message ID of endpoint should not be affected by other endpoint:", a1, a2)
+	}
+	if b2 := gen.Next("192.168.1.2:5683"); b2 != b1+1 {
+		t.Error("Message ID of endpoint should not be affected by other endpoint:", b1, b2)
+	}
+}
+
+func TestMessageIDPruneLifetime(t *testing.T) {
+	const lifetime = 10 * time.Millisecond
+	gen := NewMessageIDGenerator()
+	a1 := gen.NextWithin("[::1]:5683", lifetime)
+	time.Sleep(2 * lifetime)
+	//Many endpoints prune the ones idle more than lifetime, not EXCHANGE_LIFETIME
+	for i := 0; i < 1024; i++ {
+		gen.NextWithin(strconv.Itoa(i), lifetime)
+	}
+	if a2 := gen.NextWithin("[::1]:5683", lifetime); a2 == a1+1 {
+		t.Error("Idle endpoint should be pruned and start from random ID:", a1, a2)
+	}
+}
+
+func TestMessageIDConcurrent(t *testing.T) {
+	gen := NewMessageIDGenerator()
+	var lock sync.Mutex
+	seen := make(map[uint16]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := gen.Next("127.0.0.1:5683")
+				lock.Lock()
+				if seen[id] {
+					t.Error("Duplicate message ID:", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTokenUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		token := NewToken()
+		if len(token) != TOKEN_LENGTH {
+			t.Fatal("Token length wrong:", len(token))
+		}
+		if seen[string(token)] {
+			t.Fatal("Duplicate token:", token)
+		}
+		seen[string(token)] = true
+	}
+}
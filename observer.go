@@ -0,0 +1,332 @@
+package coapmq
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//Observe option value is 24-bit sequence number (RFC 7641 section 3.4)
+const maxObserveSeq = 1<<24 - 1
+
+//Observe sequence numbers reserved in store at once, so restored observer not reuse sent ones
+//It is far less than 2^23, notification after restart is still newer for observer.
+const observeSeqReserve = 1 << 16
+
+//Observer registration (RFC 7641), one observer is identify by address and token
+type observer struct {
+	id    string //subscriber ID
+	addr  *net.UDPAddr
+	token []byte
+	//Last Observe sequence number send to observer
+	seq uint32
+	//Sequence numbers up to it are reserved in store
+	reserved uint32
+
+	//Confirmable notifications waiting for ACK, key is message ID
+	pending     map[uint16]*pendingNotification
+	delivered   uint64
+	retransmits uint64
+	lastAck     time.Time
+}
+
+//Confirmable notification waiting for ACK, retransmit with exponential backoff (RFC 7252 section 4.2)
+type pendingNotification struct {
+	topic       string
+	conn        *net.UDPConn
+	msg         *coap.Message
+	timeout     time.Duration
+	retransmits int
+	timer       *time.Timer
+}
+
+//Delivery state of one observer, let operator find stuck subscriber
+type DeliveryState struct {
+	//Subscriber ID, "address#token"
+	Subscriber string
+	Address    string
+	//Topic filters subscribed
+	Topics []string
+	//Confirmable notifications still waiting for ACK
+	Pending int
+	//Total notifications acknowledged by subscriber
+	Delivered uint64
+	//Total retransmission send to subscriber
+	Retransmits uint64
+	//Last time got ACK, zero if never
+	LastAck time.Time
+}
+
+//Increase sequence number for next notification, caller need hold the broker lock
+func (o *observer) nextSeq() uint32 {
+	o.seq = (o.seq + 1) & maxObserveSeq
+	return o.seq
+}
+
+//Next sequence number of observer, reserve more in store when reserved ones are used up
+//Caller need hold the broker lock.
+func (c *Broker) nextSeq(obs *observer) uint32 {
+	if obs.seq == obs.reserved {
+		obs.reserved = (obs.seq + observeSeqReserve) & maxObserveSeq
+		for _, topic := range c.clientMapTopics[obs.id] {
+			sub := SubscriptionRecord{Topic: topic, Address: obs.addr.String(), Token: obs.token, Seq: obs.reserved}
+			if err := c.store.AddSubscription(sub); err != nil {
+				log.Println("Store reserve Observe sequence failed:", err)
+			}
+		}
+	}
+	return obs.nextSeq()
+}
+
+//Check if sequence number v2 is newer than v1 in 24-bit serial number arithmetic
+func newerSeq(v1, v2 uint32) bool {
+	d := (v2 - v1) & maxObserveSeq
+	return d != 0 && d < 1<<23
+}
+
+//Build notification to observer, it is 2.05 Content echo the registration token with Observe sequence number
+//Location-Path carry the concrete topic, so observer of wildcard filter know where it come from.
+func newNotification(msgID uint16, token []byte, seq uint32, topic string, value []byte, format int) *coap.Message {
+	m := new(coap.Message)
+	m.Type = coap.Confirmable
+	m.Code = coap.Content
+	m.MessageID = msgID
+	m.Token = token
+	m.Payload = value
+
+	m.SetOption(coap.Observe, seq)
+	if format != CONTENT_FORMAT_NONE {
+		m.SetOption(coap.ContentFormat, format)
+	}
+	for _, seg := range append([]string{PUBSUB_PATH}, SplitTopic(topic)...) {
+		m.AddOption(coap.LocationPath, seg)
+	}
+	return m
+}
+
+//Key to find observer from ACK or RST, which only carry message ID
+func exchangeKey(addr *net.UDPAddr, msgID uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(msgID))
+}
+
+//Initial ACK timeout is random between AckTimeout and AckTimeout * ACK_RANDOM_FACTOR
+func (c *Broker) initialTimeout() time.Duration {
+	return c.AckTimeout + time.Duration(rand.Float64()*(coap.ResponseRandomFactor-1)*float64(c.AckTimeout))
+}
+
+//Send notification to observer and wait ACK, retransmit until MaxRetransmit then evict the observer
+//maxAge tell observer how long value is fresh, 0 if it never expire.
+func (c *Broker) notify(l *net.UDPConn, id string, topic string, value []byte, format int, maxAge time.Duration) {
+	c.lock.RLock()
+	obs, exist := c.clientMapObserver[id]
+	c.lock.RUnlock()
+	if !exist {
+		return
+	}
+	//Get message ID without the lock, it may wait if too many messages to observer
+	msgID := c.getMsgID(obs.addr)
+
+	c.lock.Lock()
+	if obs, exist = c.clientMapObserver[id]; !exist {
+		c.lock.Unlock()
+		return
+	}
+	m := newNotification(msgID, obs.token, c.nextSeq(obs), topic, value, format)
+	if maxAge > 0 {
+		m.SetOption(coap.MaxAge, maxAgeSeconds(maxAge))
+	}
+	//Large value only send first block, observer get remain blocks by GET
+	setBlock2(m, value, nil, validBlockSize(c.BlockSize))
+	p := &pendingNotification{topic: topic, conn: l, msg: m, timeout: c.initialTimeout()}
+	//Newer notification replace the one still in transit, and continue its retransmission (RFC 7641 section 4.5.2)
+	for msgID, old := range obs.pending {
+		if old.topic != topic {
+			continue
+		}
+		old.timer.Stop()
+		delete(obs.pending, msgID)
+		delete(c.msgIDMapClient, exchangeKey(obs.addr, msgID))
+		p.timeout, p.retransmits = old.timeout, old.retransmits
+	}
+	obs.pending[m.MessageID] = p
+	c.msgIDMapClient[exchangeKey(obs.addr, m.MessageID)] = id
+	p.timer = time.AfterFunc(p.timeout, func() { c.retransmit(id, p) })
+	addr := obs.addr
+	c.lock.Unlock()
+
+	if err := coap.Transmit(l, addr, *m); err != nil {
+		log.Println("Error on transmit notification to", addr, " err:", err)
+	}
+}
+
+func (c *Broker) retransmit(id string, p *pendingNotification) {
+	c.lock.Lock()
+	obs, exist := c.clientMapObserver[id]
+	if !exist || obs.pending[p.msg.MessageID] != p {
+		//Already ACK or observer removed
+		c.lock.Unlock()
+		return
+	}
+
+	if p.retransmits >= c.MaxRetransmit {
+		log.Println("Notification to", obs.addr, "timeout after", p.retransmits, "retransmits, evict observer:", id)
+		c.evictObserver(id)
+		c.lock.Unlock()
+		return
+	}
+
+	p.retransmits++
+	obs.retransmits++
+	p.timeout *= 2
+	p.timer = time.AfterFunc(p.timeout, func() { c.retransmit(id, p) })
+	addr := obs.addr
+	m := *p.msg
+	c.lock.Unlock()
+
+	if err := coap.Transmit(p.conn, addr, m); err != nil {
+		log.Println("Error on retransmit notification to", addr, " err:", err)
+	}
+}
+
+//Handle ACK or RST from observer, RST means observer not interest any more (RFC 7641 section 3.6)
+func (c *Broker) handleObserverReply(a *net.UDPAddr, m *coap.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := exchangeKey(a, m.MessageID)
+	id, exist := c.msgIDMapClient[key]
+	if !exist {
+		return
+	}
+	obs, exist := c.clientMapObserver[id]
+	if !exist {
+		delete(c.msgIDMapClient, key)
+		return
+	}
+
+	if m.Type == coap.Reset {
+		log.Println("Got RST from observer, evict observer:", id)
+		c.evictObserver(id)
+		return
+	}
+
+	if p, exist := obs.pending[m.MessageID]; exist {
+		p.timer.Stop()
+		delete(obs.pending, m.MessageID)
+		delete(c.msgIDMapClient, key)
+		obs.delivered++
+		obs.lastAck = time.Now()
+	}
+}
+
+//Remove observer and all its subscriptions, caller need hold the lock
+func (c *Broker) evictObserver(id string) {
+	for _, topic := range append([]string(nil), c.clientMapTopics[id]...) {
+		c.unlinkSubscription(topic, id)
+	}
+	//Observer without any topic is removed in unlinkSubscription, but make sure if no topic left
+	c.dropObserver(id)
+}
+
+//Drop observer and stop all pending retransmission, caller need hold the lock
+func (c *Broker) dropObserver(id string) {
+	obs, exist := c.clientMapObserver[id]
+	if !exist {
+		return
+	}
+	for msgID, p := range obs.pending {
+		p.timer.Stop()
+		delete(c.msgIDMapClient, exchangeKey(obs.addr, msgID))
+	}
+	delete(c.clientMapObserver, id)
+}
+
+//Get delivery state of all observers, sorted by subscriber ID
+func (c *Broker) DeliveryStates() []DeliveryState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var states []DeliveryState
+	for id, obs := range c.clientMapObserver {
+		states = append(states, DeliveryState{
+			Subscriber:  id,
+			Address:     obs.addr.String(),
+			Topics:      append([]string(nil), c.clientMapTopics[id]...),
+			Pending:     len(obs.pending),
+			Delivered:   obs.delivered,
+			Retransmits: obs.retransmits,
+			LastAck:     obs.lastAck,
+		})
+	}
+	sort.Sort(byDeliverySubscriber(states))
+	return states
+}
+
+type byDeliverySubscriber []DeliveryState
+
+func (s byDeliverySubscriber) Len() int           { return len(s) }
+func (s byDeliverySubscriber) Less(i, j int) bool { return s[i].Subscriber < s[j].Subscriber }
+func (s byDeliverySubscriber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//Count confirmable notifications waiting for ACK
+func (c *Broker) pendingNotifications() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	count := 0
+	for _, obs := range c.clientMapObserver {
+		count += len(obs.pending)
+	}
+	return count
+}
+
+//Stop all retransmission, pending notifications are dropped
+func (c *Broker) stopRetransmit() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, obs := range c.clientMapObserver {
+		for msgID, p := range obs.pending {
+			p.timer.Stop()
+			delete(obs.pending, msgID)
+			delete(c.msgIDMapClient, exchangeKey(obs.addr, msgID))
+		}
+	}
+}
+
+//Send 5.03 Service Unavailable to all observers, it end the registration (RFC 7641 section 3.2)
+func (c *Broker) notifyShutdown() {
+	c.lock.RLock()
+	var msgs []*coap.Message
+	var addrs []*net.UDPAddr
+	for _, obs := range c.clientMapObserver {
+		m := new(coap.Message)
+		m.Type = coap.NonConfirmable
+		m.Code = coap.ServiceUnavailable
+		m.Token = obs.token
+		msgs = append(msgs, m)
+		addrs = append(addrs, obs.addr)
+	}
+	c.lock.RUnlock()
+	//Get message ID without the lock, it may wait if too many messages to observer
+	for k, m := range msgs {
+		m.MessageID = c.getMsgID(addrs[k])
+	}
+
+	c.serveLock.Lock()
+	defer c.serveLock.Unlock()
+	for conn := range c.conns {
+		for k, m := range msgs {
+			if err := coap.Transmit(conn, addrs[k], *m); err != nil {
+				log.Println("Error on notify shutdown to", addrs[k], " err:", err)
+			}
+		}
+		//Only send once, from first serving conn
+		break
+	}
+}
@@ -0,0 +1,112 @@
+package coapmq
+
+import (
+	"net"
+
+	"github.com/dustin/go-coap"
+)
+
+//Current usage of broker against its limits, limit 0 means unlimited
+type BrokerStats struct {
+	Topics     int
+	TopicLimit int
+
+	//Total subscriptions and subscribers (address and token)
+	Subscriptions int
+	Subscribers   int
+
+	//Most subscriptions of single client address
+	MaxClientSubscriptions  int
+	ClientSubscriptionLimit int
+
+	//Most subscribers of single topic filter
+	MaxTopicSubscribers  int
+	TopicSubscriberLimit int
+
+	//Total and largest payload of topic values
+	PayloadBytes int
+	MaxPayload   int
+	PayloadLimit int
+
+	//Responses cached for duplicate detection
+	CachedExchanges int
+}
+
+//Return current usage and limits of broker
+func (c *Broker) Stats() BrokerStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	s := BrokerStats{
+		Topics:                  len(c.topicMapValue),
+		TopicLimit:              c.Capacity,
+		Subscribers:             len(c.clientMapObserver),
+		ClientSubscriptionLimit: c.MaxClientSubscriptions,
+		TopicSubscriberLimit:    c.MaxTopicSubscribers,
+		PayloadLimit:            c.MaxPayloadSize,
+		CachedExchanges:         c.dedup.size(),
+	}
+
+	perClient := make(map[string]int)
+	for client, topics := range c.clientMapTopics {
+		s.Subscriptions += len(topics)
+		if obs, exist := c.clientMapObserver[client]; exist {
+			perClient[obs.addr.String()] += len(topics)
+		}
+	}
+	for _, count := range perClient {
+		if count > s.MaxClientSubscriptions {
+			s.MaxClientSubscriptions = count
+		}
+	}
+	c.topicMapClients.walk(func(filter string, clients []string) {
+		if len(clients) > s.MaxTopicSubscribers {
+			s.MaxTopicSubscribers = len(clients)
+		}
+	})
+	for _, value := range c.topicMapValue {
+		s.PayloadBytes += len(value)
+		if len(value) > s.MaxPayload {
+			s.MaxPayload = len(value)
+		}
+	}
+	return s
+}
+
+//Check topic limit before create, caller need hold the lock
+func (c *Broker) checkTopicQuota() coap.COAPCode {
+	if c.Capacity > 0 && len(c.topicMapValue) >= c.Capacity {
+		return coap.ServiceUnavailable
+	}
+	return coap.Created
+}
+
+//Check subscription limits before add new subscription, caller need hold the lock
+func (c *Broker) checkSubscriptionQuota(topic string, addr *net.UDPAddr) coap.COAPCode {
+	if c.MaxTopicSubscribers > 0 && len(c.topicMapClients.subscribers(topic)) >= c.MaxTopicSubscribers {
+		return coap.ServiceUnavailable
+	}
+	if c.MaxClientSubscriptions > 0 && c.clientSubscriptions(addr) >= c.MaxClientSubscriptions {
+		return coap.ServiceUnavailable
+	}
+	return coap.Content
+}
+
+//Count subscriptions from same client address with any token, caller need hold the lock
+func (c *Broker) clientSubscriptions(addr *net.UDPAddr) int {
+	count := 0
+	for client, obs := range c.clientMapObserver {
+		if SameUDPAddr(obs.addr, addr) {
+			count += len(c.clientMapTopics[client])
+		}
+	}
+	return count
+}
+
+//Check payload size before publish
+func (c *Broker) checkPayloadQuota(value []byte) coap.COAPCode {
+	if c.MaxPayloadSize > 0 && len(value) > c.MaxPayloadSize {
+		return coap.RequestEntityTooLarge
+	}
+	return coap.Changed
+}
@@ -0,0 +1,106 @@
+package coapmq_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func subscribeMsg(t *testing.T, msgID uint16, topic string, token string) *coap.Message {
+	m := EncodeMessage(msgID, CMD_SUBSCRIBE, "", topic)
+	m.Token = []byte(token)
+	return wireMessage(t, m)
+}
+
+func TestTopicQuota(t *testing.T) {
+	broker := newBroker(t)
+	broker.Capacity = 2
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+
+	for k, topic := range []string{"t1", "t2"} {
+		if rv := broker.ServeCOAP(nil, client, EncodeMessage(uint16(k), CMD_CREATE, "", topic)); rv.Code != coap.Created {
+			t.Fatal("Create topic under limit failed:", rv.Code)
+		}
+	}
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_CREATE, "", "t3")); rv.Code != coap.ServiceUnavailable {
+		t.Error("Create topic over limit should get 5.03, got:", rv.Code)
+	}
+
+	broker.ServeCOAP(nil, client, EncodeMessage(4, CMD_REMOVE, "", "t1"))
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(5, CMD_CREATE, "", "t3")); rv.Code != coap.Created {
+		t.Error("Create topic after remove failed:", rv.Code)
+	}
+
+	stats := broker.Stats()
+	if stats.Topics != 2 || stats.TopicLimit != 2 {
+		t.Error("Wrong topic stats:", stats)
+	}
+}
+
+func TestPayloadQuota(t *testing.T) {
+	broker := newBroker(t)
+	broker.MaxPayloadSize = 4
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+
+	rv := broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "12345", "t1"))
+	if rv.Code != coap.RequestEntityTooLarge {
+		t.Error("Publish over limit should get 4.13, got:", rv.Code)
+	}
+	if size, _ := wireMessage(t, rv).Option(coap.Size1).(uint32); size != 4 {
+		t.Error("4.13 should include Size1=4, got:", rv.Option(coap.Size1))
+	}
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_PUBLISH, "1234", "t1")); rv.Code != coap.Changed {
+		t.Error("Publish under limit failed:", rv.Code)
+	}
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(4, CMD_READ, "", "t1")); string(rv.Payload) != "1234" {
+		t.Error("Rejected publish should not change value, got:", string(rv.Payload))
+	}
+
+	stats := broker.Stats()
+	if stats.PayloadBytes != 4 || stats.MaxPayload != 4 || stats.PayloadLimit != 4 {
+		t.Error("Wrong payload stats:", stats)
+	}
+}
+
+func TestSubscriptionQuota(t *testing.T) {
+	broker := newBroker(t)
+	broker.MaxTopicSubscribers = 2
+	broker.MaxClientSubscriptions = 2
+	client1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	client2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+	client3 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10003}
+	for k, topic := range []string{"t1", "t2", "t3"} {
+		broker.ServeCOAP(nil, client1, EncodeMessage(uint16(k), CMD_CREATE, "", topic))
+	}
+
+	//Limit per client address count all tokens
+	if rv := broker.ServeCOAP(nil, client1, subscribeMsg(t, 10, "t1", "a")); rv.Code != coap.Content {
+		t.Fatal("Subscribe failed:", rv.Code)
+	}
+	if rv := broker.ServeCOAP(nil, client1, subscribeMsg(t, 11, "t2", "b")); rv.Code != coap.Content {
+		t.Fatal("Subscribe failed:", rv.Code)
+	}
+	if rv := broker.ServeCOAP(nil, client1, subscribeMsg(t, 12, "t3", "c")); rv.Code != coap.ServiceUnavailable {
+		t.Error("Subscribe over client limit should get 5.03, got:", rv.Code)
+	}
+	//Subscribe again is not a new subscription
+	if rv := broker.ServeCOAP(nil, client1, subscribeMsg(t, 13, "t1", "a")); rv.Code != coap.Content {
+		t.Error("Subscribe again should not count on limit, got:", rv.Code)
+	}
+
+	//Limit per topic
+	if rv := broker.ServeCOAP(nil, client2, subscribeMsg(t, 14, "t1", "a")); rv.Code != coap.Content {
+		t.Fatal("Subscribe failed:", rv.Code)
+	}
+	if rv := broker.ServeCOAP(nil, client3, subscribeMsg(t, 15, "t1", "a")); rv.Code != coap.ServiceUnavailable {
+		t.Error("Subscribe over topic limit should get 5.03, got:", rv.Code)
+	}
+
+	stats := broker.Stats()
+	if stats.Subscriptions != 3 || stats.Subscribers != 3 || stats.MaxClientSubscriptions != 2 || stats.MaxTopicSubscribers != 2 {
+		t.Error("Wrong subscription stats:", stats)
+	}
+}
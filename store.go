@@ -0,0 +1,144 @@
+package coapmq
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+//Store persist topics, their latest values and subscriptions of broker
+//Broker write through every change to store, and load all records back when created.
+type Store interface {
+	//Create topic with link-format attributes (rt, ct, if...)
+	CreateTopic(topic string, attrs map[string]string) error
+	RemoveTopic(topic string) error
+	//Update latest value of topic
+	SetValue(topic string, value []byte) error
+	AddSubscription(sub SubscriptionRecord) error
+	RemoveSubscription(sub SubscriptionRecord) error
+	//Load all topics and subscriptions
+	Load() ([]TopicRecord, []SubscriptionRecord, error)
+	Close() error
+}
+
+//Topic stored in Store
+type TopicRecord struct {
+	Topic string
+	Attrs map[string]string
+	Value []byte
+}
+
+//Subscription stored in Store, topic could be a filter with wildcard
+type SubscriptionRecord struct {
+	Topic   string
+	Address string
+	Token   []byte
+	//Observe sequence numbers up to it may be used, restored observer continue after it
+	Seq uint32
+}
+
+func (s SubscriptionRecord) key() string {
+	return s.Address + "#" + hex.EncodeToString(s.Token) + " " + s.Topic
+}
+
+//Store keep everything in memory, all data is lost when process exit
+//It is the default store of broker.
+type MemoryStore struct {
+	lock   sync.RWMutex
+	topics map[string]*TopicRecord
+	subs   map[string]SubscriptionRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := new(MemoryStore)
+	s.topics = make(map[string]*TopicRecord)
+	s.subs = make(map[string]SubscriptionRecord)
+	return s
+}
+
+func (s *MemoryStore) CreateTopic(topic string, attrs map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.topics[topic] = &TopicRecord{Topic: topic, Attrs: copyAttrs(attrs)}
+	return nil
+}
+
+func (s *MemoryStore) RemoveTopic(topic string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.topics, topic)
+	return nil
+}
+
+func (s *MemoryStore) SetValue(topic string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t, exist := s.topics[topic]; exist {
+		t.Value = append([]byte(nil), value...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddSubscription(sub SubscriptionRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.subs[sub.key()] = sub
+	return nil
+}
+
+func (s *MemoryStore) RemoveSubscription(sub SubscriptionRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.subs, sub.key())
+	return nil
+}
+
+//Load all topics sorted by name, so parent topic is always before its children
+func (s *MemoryStore) Load() ([]TopicRecord, []SubscriptionRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var names []string
+	for name := range s.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var topics []TopicRecord
+	for _, name := range names {
+		t := s.topics[name]
+		topics = append(topics, TopicRecord{Topic: t.Topic, Attrs: copyAttrs(t.Attrs), Value: append([]byte(nil), t.Value...)})
+	}
+
+	var keys []string
+	for key := range s.subs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var subs []SubscriptionRecord
+	for _, key := range keys {
+		subs = append(subs, s.subs[key])
+	}
+	return topics, subs, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func copyAttrs(attrs map[string]string) map[string]string {
+	if attrs == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		ret[k] = v
+	}
+	return ret
+}
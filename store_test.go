@@ -0,0 +1,275 @@
+package coapmq_test
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func openFileStore(t *testing.T, dir string) *FileStore {
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal("Open file store failed:", err)
+	}
+	return store
+}
+
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Open log failed:", err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coapmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	var msgID uint16
+	serve := func(broker *Broker, cmd CMD_TYPE, topic string, msg string) *coap.Message {
+		msgID++
+		m := EncodeMessage(msgID, cmd, msg, topic)
+		m.Token = []byte("tk")
+		return broker.ServeCOAP(nil, client, wireMessage(t, m))
+	}
+
+	store := openFileStore(t, dir)
+	broker, err := NewBroker(1024, store)
+	if err != nil {
+		t.Fatal("Create broker failed:", err)
+	}
+	for _, topic := range []string{"building1", "building1/temp", "building2", "tmp"} {
+		serve(broker, CMD_CREATE, topic, "")
+	}
+	serve(broker, CMD_PUBLISH, "building1/temp", "25")
+	serve(broker, CMD_REMOVE, "tmp", "")
+	serve(broker, CMD_SUBSCRIBE, "building1/temp", "")
+	store.Close()
+
+	//Restart broker on same data directory
+	store = openFileStore(t, dir)
+	defer store.Close()
+	broker, err = NewBroker(1024, store)
+	if err != nil {
+		t.Fatal("Restart broker failed:", err)
+	}
+
+	if rv := serve(broker, CMD_READ, "building1/temp", ""); rv.Code != coap.Content || string(rv.Payload) != "25" {
+		t.Error("Read topic after restart failed:", rv.Code, string(rv.Payload))
+	}
+	if rv := serve(broker, CMD_DISCOVER, "", ""); string(rv.Payload) != "</ps/building1>;obs,</ps/building1/temp>;obs,</ps/building2>;obs" {
+		t.Error("Topics after restart failed:", string(rv.Payload))
+	}
+	states := broker.DeliveryStates()
+	if len(states) != 1 || states[0].Subscriber != SubscriberID(client, []byte("tk")) || states[0].Topics[0] != "building1/temp" {
+		t.Error("Subscription after restart failed:", states)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coapmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openFileStore(t, dir)
+	store.CompactThreshold = 10
+	store.CreateTopic("t1", map[string]string{"rt": "temperature"})
+	for i := 0; i < 100; i++ {
+		if err := store.SetValue("t1", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal("Set value failed:", err)
+		}
+	}
+	store.AddSubscription(SubscriptionRecord{Topic: "t1", Address: "127.0.0.1:5700", Token: []byte{1}})
+	store.Close()
+
+	if lines := countLines(t, filepath.Join(dir, "coapmq.log")); lines > 10 {
+		t.Error("Log should be compacted, lines:", lines)
+	}
+
+	store = openFileStore(t, dir)
+	defer store.Close()
+	topics, subs, err := store.Load()
+	if err != nil || len(topics) != 1 || len(subs) != 1 {
+		t.Fatal("Load after compaction failed:", topics, subs, err)
+	}
+	if topics[0].Topic != "t1" || string(topics[0].Value) != "99" || topics[0].Attrs["rt"] != "temperature" {
+		t.Error("Topic after compaction failed:", topics[0])
+	}
+}
+
+func TestFileStoreCompactionFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coapmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//Directory on tmp path make compaction fail
+	tmpPath := filepath.Join(dir, "coapmq.log.tmp")
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store := openFileStore(t, dir)
+	store.CompactThreshold = 10
+	store.CreateTopic("t1", nil)
+	for i := 0; i < 30; i++ {
+		if err := store.SetValue("t1", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal("Set value should not fail by compaction:", err)
+		}
+	}
+	if lines := countLines(t, filepath.Join(dir, "coapmq.log")); lines != 31 {
+		t.Error("All records should be kept in log, lines:", lines)
+	}
+
+	//Compaction is retried later
+	os.Remove(tmpPath)
+	for i := 30; i < 50; i++ {
+		if err := store.SetValue("t1", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal("Set value failed:", err)
+		}
+	}
+	store.Close()
+	if lines := countLines(t, filepath.Join(dir, "coapmq.log")); lines > 20 {
+		t.Error("Log should be compacted after failure, lines:", lines)
+	}
+
+	store = openFileStore(t, dir)
+	defer store.Close()
+	if topics, _, err := store.Load(); err != nil || len(topics) != 1 || string(topics[0].Value) != "49" {
+		t.Error("Value after compaction failure lost:", topics, err)
+	}
+}
+
+func TestFileStoreTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coapmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openFileStore(t, dir)
+	store.CreateTopic("a", nil)
+	store.Close()
+
+	//Crash in the middle of writing a record
+	file, err := os.OpenFile(filepath.Join(dir, "coapmq.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("Open log failed:", err)
+	}
+	file.WriteString(`{"op":"create","top`)
+	file.Close()
+
+	store = openFileStore(t, dir)
+	if err := store.CreateTopic("b", nil); err != nil {
+		t.Fatal("Create topic after recovery failed:", err)
+	}
+	store.Close()
+
+	store = openFileStore(t, dir)
+	defer store.Close()
+	topics, _, err := store.Load()
+	if err != nil || len(topics) != 2 {
+		t.Fatal("Topic created after recovery lost:", topics, err)
+	}
+	if lines := countLines(t, filepath.Join(dir, "coapmq.log")); lines != 2 {
+		t.Error("Torn record should be dropped, lines:", lines)
+	}
+}
+
+func TestMemoryStoreSharedByBrokers(t *testing.T) {
+	store := NewMemoryStore()
+	broker, _ := NewBroker(1024, store)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5700}
+	broker.ServeCOAP(nil, client, EncodeMessage(1, CMD_CREATE, "", "t1"))
+	broker.ServeCOAP(nil, client, EncodeMessage(2, CMD_PUBLISH, "v1", "t1"))
+
+	broker, _ = NewBroker(1024, store)
+	if rv := broker.ServeCOAP(nil, client, EncodeMessage(3, CMD_READ, "", "t1")); rv.Code != coap.Content || string(rv.Payload) != "v1" {
+		t.Error("Read topic from shared store failed:", rv.Code, string(rv.Payload))
+	}
+}
+
+func TestFileStoreRestartNotification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coapmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openFileStore(t, dir)
+	broker, err := NewBroker(1024, store)
+	if err != nil {
+		t.Fatal("Create broker failed:", err)
+	}
+	conn := serveBroker(t, broker)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	client := newClient(t, addr.String())
+	//No heart beat resync, notification after restart must be fresh by itself
+	client.SetHeartBeat(time.Hour)
+	client.CreateTopic("t1", nil)
+	values := make(chan string, 16)
+	if err := client.Subscribe("t1", func(n Notification) { values <- string(n.Payload) }); err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	wait := func(value string) {
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case v := <-values:
+				if v == value {
+					return
+				}
+			case <-timeout:
+				t.Fatal("No notification of value:", value)
+			}
+		}
+	}
+	for _, v := range []string{"v1", "v2", "v3"} {
+		client.Publish("t1", v)
+	}
+	wait("v3")
+
+	//Restart broker with observer restored from store
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	broker.Shutdown(ctx)
+	cancel()
+	store.Close()
+	store = openFileStore(t, dir)
+	defer store.Close()
+	if broker, err = NewBroker(1024, store); err != nil {
+		t.Fatal("Restart broker failed:", err)
+	}
+	conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer conn.Close()
+	go broker.Serve(context.Background(), conn)
+
+	client.Publish("t1", "v4")
+	wait("v4")
+}
@@ -0,0 +1,141 @@
+package coapmq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+//What to do when subscription channel is full
+type DropPolicy int
+
+const (
+	//Wait for reader, notifications are still acknowledged so broker keep the subscription
+	//Only latest notifications are queued while waiting, older ones are dropped when queue is full.
+	POLICY_BLOCK DropPolicy = iota
+	//Drop oldest payload in channel, reader always get latest value
+	//It need SubscriptionBuffer > 0, same as POLICY_DROP_NEWEST on unbuffered channel.
+	POLICY_DROP_OLDEST
+	//Drop new payload until reader catch up
+	POLICY_DROP_NEWEST
+)
+
+//Notification of subscription, pass to handler of Subscribe
+type Notification struct {
+	//Topic of value, it is the matched topic for wildcard subscription
+	Topic   string
+	Payload []byte
+	//Content-Format of payload, CONTENT_FORMAT_NONE if topic has no format
+	ContentFormat int
+	//Observe sequence number, it increase on each notification of a subscription
+	Observe uint32
+	//Time client received the notification
+	Received time.Time
+}
+
+//Add Subscription on topic, handler is called with each notification in order
+//Handler run in goroutine of the subscription, slow handler delay later notifications.
+func (c *Client) Subscribe(topic string, handler func(Notification)) error {
+	return c.SubscribeContext(context.Background(), topic, handler)
+}
+
+//Same as Subscribe, subscription last until ctx is done
+//Registration fail after retransmissions even ctx has a later deadline, see SetRetransmit.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, handler func(Notification)) error {
+	sub := subConnection{stop: make(chan struct{}), handler: handler}
+	_, created, err := c.subscribe(ctx, NewCmd(CMD_SUBSCRIBE, topic, nil), sub)
+	if err == nil && !created {
+		return errors.New("Already subscribe this topic.")
+	}
+	return err
+}
+
+//Send payload to subscription channel, follow policy if channel is full
+//Unbuffered channel has no oldest payload to drop, POLICY_DROP_OLDEST drop newest one on it.
+func (c *Client) sendChannel(ctx context.Context, stop chan struct{}, ch chan []byte, data []byte, policy DropPolicy) {
+	if policy == POLICY_DROP_OLDEST && cap(ch) == 0 {
+		policy = POLICY_DROP_NEWEST
+	}
+	switch policy {
+	case POLICY_DROP_NEWEST:
+		select {
+		case ch <- data:
+		default:
+			log.Println("Subscription channel full, drop newest")
+		}
+	case POLICY_DROP_OLDEST:
+		for {
+			select {
+			case ch <- data:
+				return
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			default:
+			}
+			select {
+			case <-ch:
+				log.Println("Subscription channel full, drop oldest")
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			default:
+			}
+		}
+	default:
+		select {
+		case ch <- data:
+		case <-stop:
+		case <-ctx.Done():
+		case <-c.done:
+		}
+	}
+}
+
+//Latest notification of subscription, for freshness check of RFC 7641 section 3.4
+type observeFreshness struct {
+	lock     sync.Mutex
+	seq      uint32
+	received time.Time
+}
+
+//Take notification as latest one after registration
+func (f *observeFreshness) reset(seq uint32, t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.seq, f.received = seq, t
+}
+
+//Return true and keep it as latest one if notification is newer
+//Sequence number is 24-bit and wrap, it is newer if it is ahead in half range or latest one is older than 128 seconds.
+func (f *observeFreshness) update(seq uint32, t time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v1, v2 := f.seq, seq
+	fresh := (v1 < v2 && v2-v1 < 1<<23) || (v1 > v2 && v1-v2 > 1<<23) || t.After(f.received.Add(observeFreshTime))
+	if fresh {
+		f.seq, f.received = seq, t
+	}
+	return fresh
+}
+
+//Observe sequence number of notification
+func observeSeq(m *coap.Message) uint32 {
+	switch v := m.Option(coap.Observe).(type) {
+	case uint32:
+		return v
+	case int:
+		return uint32(v)
+	}
+	return 0
+}
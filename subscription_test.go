@@ -0,0 +1,288 @@
+package coapmq_test
+
+import (
+	"encoding/hex"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-coap"
+	. "github.com/kkdai/coapmq"
+)
+
+func TestClientSubscribeHandler(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("sensors", nil)
+	client.CreateTopicFormat("sensors/temp", coap.AppJSON)
+
+	ch := make(chan Notification, 10)
+	if err := client.Subscribe("sensors/#", func(n Notification) { ch <- n }); err != nil {
+		t.Fatal("Subscribe with handler failed:", err)
+	}
+	if err := client.Subscribe("sensors/#", func(n Notification) {}); err == nil {
+		t.Error("Subscribe same topic again should fail")
+	}
+
+	start := time.Now()
+	client.PublishFormat("sensors/temp", []byte(`{"t":21}`), coap.AppJSON)
+	client.PublishFormat("sensors/temp", []byte(`{"t":22}`), coap.AppJSON)
+	var last uint32
+	for i, want := range []string{`{"t":21}`, `{"t":22}`} {
+		select {
+		case n := <-ch:
+			if n.Topic != "sensors/temp" || string(n.Payload) != want || n.ContentFormat != int(coap.AppJSON) {
+				t.Error("Notification wrong:", n.Topic, string(n.Payload), n.ContentFormat)
+			}
+			if i > 0 && n.Observe <= last {
+				t.Error("Observe sequence should increase:", last, n.Observe)
+			}
+			if n.Received.Before(start) {
+				t.Error("Receive time wrong:", n.Received)
+			}
+			last = n.Observe
+		case <-time.After(3 * time.Second):
+			t.Fatal("No notification to handler")
+		}
+	}
+}
+
+func TestClientDropPolicy(t *testing.T) {
+	for policy, want := range map[DropPolicy][]string{
+		POLICY_BLOCK:       {"v1", "v2", "v3", "v4", "v5"},
+		POLICY_DROP_OLDEST: {"v4", "v5"},
+		POLICY_DROP_NEWEST: {"v1", "v2"},
+	} {
+		_, conn := startBroker(t)
+		client := newClient(t, conn.LocalAddr().String())
+		client.SubscriptionBuffer = 2
+		client.DropPolicy = policy
+		client.CreateTopic("t1", nil)
+		ch, err := client.SubscriptionBytes("t1")
+		if err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+
+		//Slow reader, not read until all values are published
+		for i := 1; i <= 5; i++ {
+			client.Publish("t1", "v"+strconv.Itoa(i))
+		}
+		time.Sleep(200 * time.Millisecond)
+		for _, val := range want {
+			select {
+			case got := <-ch:
+				if string(got) != val {
+					t.Error("Policy", policy, "got:", string(got), "want:", val)
+				}
+			case <-time.After(3 * time.Second):
+				t.Error("Policy", policy, "not get:", val)
+			}
+		}
+		select {
+		case got := <-ch:
+			t.Error("Policy", policy, "should drop:", string(got))
+		case <-time.After(100 * time.Millisecond):
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+//Wait goroutines of stopped subscriptions exit, return false if count not back to n
+func waitGoroutines(n int) bool {
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestClientUnsubscribe(t *testing.T) {
+	broker, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	client.CreateTopic("t2", nil)
+
+	before := runtime.NumGoroutine()
+	strCh, err := client.Subscription("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	byteCh, err := client.SubscriptionBytes("t2")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Error("Subscriptions should run goroutines")
+	}
+
+	//Nobody read, subscription goroutines are blocked on channel
+	client.Publish("t1", "v1")
+	client.Publish("t2", "v1")
+	time.Sleep(100 * time.Millisecond)
+
+	for _, topic := range []string{"t1", "t2"} {
+		if err := client.UnsubscribeTopic(topic); err != nil {
+			t.Error("Unsubscribe failed:", err)
+		}
+	}
+	if !waitGoroutines(before) {
+		t.Error("Goroutines not stopped after unsubscribe:", before, runtime.NumGoroutine())
+	}
+	if v, ok := <-strCh; ok {
+		t.Error("String channel should be closed:", v)
+	}
+	if v, ok := <-byteCh; ok {
+		t.Error("Bytes channel should be closed:", string(v))
+	}
+	if states := broker.DeliveryStates(); len(states) != 0 {
+		t.Error("Broker should remove subscriptions:", states)
+	}
+	if err := client.UnsubscribeTopic("t1"); err == nil {
+		t.Error("Unsubscribe again should fail")
+	}
+
+	//Subscribe again after unsubscribe
+	strCh, err = client.Subscription("t1")
+	if err != nil {
+		t.Fatal("Subscribe again failed:", err)
+	}
+	client.Publish("t1", "v2")
+	if val := <-strCh; val != "v2" {
+		t.Error("Notification after subscribe again failed:", val)
+	}
+}
+
+func TestClientDropOldestUnbuffered(t *testing.T) {
+	_, conn := startBroker(t)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	//Default unbuffered channel, nobody read it
+	client.DropPolicy = POLICY_DROP_OLDEST
+	client.CreateTopic("t1", nil)
+	ch, err := client.SubscriptionBytes("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	before := runtime.NumGoroutine()
+	for i := 1; i <= 3; i++ {
+		client.Publish("t1", "v"+strconv.Itoa(i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Error("Subscription should drop value instead of wait reader:", before, n)
+	}
+	if err := client.UnsubscribeTopic("t1"); err != nil {
+		t.Error("Unsubscribe failed:", err)
+	}
+	if v, ok := <-ch; ok {
+		t.Error("Channel should be closed:", string(v))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Error("Close hang after unsubscribe")
+	}
+}
+
+func TestClientBlockSlowReader(t *testing.T) {
+	broker := newBroker(t)
+	broker.AckTimeout = 50 * time.Millisecond
+	broker.MaxRetransmit = 1
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	ch, err := client.SubscriptionBytes("t1")
+	if err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+	//Nobody read channel, client queue is full
+	for i := 0; i < 25; i++ {
+		client.Publish("t1", "v"+strconv.Itoa(i))
+	}
+	time.Sleep(300 * time.Millisecond)
+	if states := broker.DeliveryStates(); len(states) != 1 {
+		t.Fatal("Slow reader should not be evicted:", states)
+	}
+
+	//Reader catch up and get later value
+	client.Publish("t1", "last")
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case v := <-ch:
+			if string(v) == "last" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Subscription not alive after slow reader")
+		}
+	}
+}
+
+func TestClientStaleNotification(t *testing.T) {
+	broker := newBroker(t)
+	conn := serveBroker(t, broker)
+	defer conn.Close()
+
+	client := newClient(t, conn.LocalAddr().String())
+	client.CreateTopic("t1", nil)
+	ch := make(chan Notification, 10)
+	if err := client.Subscribe("t1", func(n Notification) { ch <- n }); err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	var got []Notification
+	for _, v := range []string{"v1", "v2"} {
+		client.Publish("t1", v)
+		select {
+		case n := <-ch:
+			got = append(got, n)
+		case <-time.After(3 * time.Second):
+			t.Fatal("No notification of:", v)
+		}
+	}
+
+	//Late retransmission of v1 with another message ID, as it was in transit with v2
+	states := broker.DeliveryStates()
+	if len(states) != 1 {
+		t.Fatal("Subscription not found:", states)
+	}
+	token, _ := hex.DecodeString(states[0].Subscriber[strings.LastIndex(states[0].Subscriber, "#")+1:])
+	addr, _ := net.ResolveUDPAddr("udp", states[0].Address)
+	stale := coap.Message{Type: coap.Confirmable, Code: coap.Content, MessageID: 0xbeef, Token: token, Payload: []byte("v1")}
+	stale.SetOption(coap.Observe, got[0].Observe)
+	stale.AddOption(coap.LocationPath, PUBSUB_PATH)
+	stale.AddOption(coap.LocationPath, "t1")
+	if err := coap.Transmit(conn, addr, stale); err != nil {
+		t.Fatal("Send stale notification failed:", err)
+	}
+
+	client.Publish("t1", "v3")
+	select {
+	case n := <-ch:
+		if string(n.Payload) != "v3" {
+			t.Error("Stale notification should be dropped, got:", string(n.Payload))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("No notification of v3")
+	}
+}
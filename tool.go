@@ -1,12 +1,11 @@
 package coapmq
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/dustin/go-coap"
@@ -36,60 +35,25 @@ func ParseUint8ToString(in interface{}) string {
 	}
 }
 
-//According to RFC 7252, message ID need IP with a random number
-//Get random number locally
-func GetLocalRandomInt() uint16 {
-	rand.Seed(time.Now().UnixNano())
-	return uint16(rand.Intn(1000))
+//Canonical subscriber identity, combine with address string and CoAP token
+//go-coap create new *net.UDPAddr for each datagram, so do not compare pointer.
+func SubscriberID(addr *net.UDPAddr, token []byte) string {
+	return addr.String() + "#" + hex.EncodeToString(token)
 }
 
-//According to RFC 7252, we need indicate message ID with sender IP or address + random number
-//Get local IPV4 address to uint16 by <<8
-func GetIPv4Int16() uint16 {
-
-	ifaces, err := net.Interfaces()
-	// handle err
-	if err != nil {
-		log.Println("No network:", err)
-		return 0
+//Compare UDP address by value
+func SameUDPAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
-
-	for _, i := range ifaces {
-		if strings.Contains(i.Name, "en0") {
-			addrs, err := i.Addrs()
-			// handle err
-			if err != nil {
-				log.Println("No IP:", err)
-				return 0
-			}
-
-			for _, addr := range addrs {
-				var ip net.IP
-				switch v := addr.(type) {
-				case *net.IPNet:
-					ip = v.IP
-				case *net.IPAddr:
-					ip = v.IP
-				}
-				// process IP address
-				if ip[0] == 0 {
-					//target XX.XX.XX.XX ipv4
-					var myIP uint16
-					myIP = uint16(ip[12])<<8 + uint16(ip[13])<<7 + uint16(ip[14])<<6 + uint16(ip[13])<<6
-					return myIP
-				}
-			}
-		}
-	}
-
-	return 0
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
 }
 
 func RemoveClientFromSlice(slice []*net.UDPAddr, target *net.UDPAddr) []*net.UDPAddr {
 	var retSlice []*net.UDPAddr
 	removeIndex := -1
 	for k, v := range slice {
-		if v == target {
+		if SameUDPAddr(v, target) {
 			removeIndex = k
 		}
 	}
@@ -105,6 +69,15 @@ func RemoveClientFromSlice(slice []*net.UDPAddr, target *net.UDPAddr) []*net.UDP
 	return retSlice
 }
 
+func ContainString(slice []string, target string) bool {
+	for _, v := range slice {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
 func RemoveStringFromSlice(slice []string, target string) []string {
 	var retSlice []string
 	removeIndex := -1
@@ -1,6 +1,7 @@
 package coapmq_test
 
 import (
+	"net"
 	"testing"
 
 	. "github.com/kkdai/coapmq"
@@ -30,3 +31,25 @@ func TestSliceElementRemvoe(t *testing.T) {
 		t.Error("Remove remain item failed")
 	}
 }
+
+func TestRemoveClientByValue(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5684}
+	slice := []*net.UDPAddr{a, b}
+
+	ret := RemoveClientFromSlice(slice, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683})
+	if len(ret) != 1 || ret[0] != b {
+		t.Error("Remove client by value failed:", ret)
+	}
+}
+
+func TestSubscriberID(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+	if SubscriberID(a, []byte{1}) != SubscriberID(b, []byte{1}) {
+		t.Error("Same address and token should be same subscriber")
+	}
+	if SubscriberID(a, []byte{1}) == SubscriberID(b, []byte{2}) {
+		t.Error("Different token should be different subscriber")
+	}
+}
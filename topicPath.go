@@ -0,0 +1,66 @@
+package coapmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+//Join path segments to topic, segment must not be empty or contain "/"
+//Wildcard segment is allowed, broker only accept it on subscription.
+func TopicPath(segments []string) (string, error) {
+	if len(segments) == 0 {
+		return "", errors.New("Topic path has no segment")
+	}
+	for _, seg := range segments {
+		if seg == "" || strings.Contains(seg, "/") {
+			return "", errors.New("Invalid topic segment: \"" + seg + "\"")
+		}
+	}
+	return JoinTopic(segments), nil
+}
+
+//Same as CreateTopicContext, topic is given by path segments such as []string{"building1", "temp"}
+func (c *Client) CreateTopicPath(ctx context.Context, segments []string, attrs map[string]string) (string, error) {
+	topic, err := TopicPath(segments)
+	if err != nil {
+		return "", err
+	}
+	return c.CreateTopicContext(ctx, topic, attrs)
+}
+
+//Same as PublishContext, topic is given by path segments
+func (c *Client) PublishPath(ctx context.Context, segments []string, data []byte) error {
+	topic, err := TopicPath(segments)
+	if err != nil {
+		return err
+	}
+	return c.PublishContext(ctx, topic, data)
+}
+
+//Same as ReadTopicContext, topic is given by path segments
+func (c *Client) ReadTopicPath(ctx context.Context, segments []string) ([]byte, error) {
+	topic, err := TopicPath(segments)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReadTopicContext(ctx, topic)
+}
+
+//Same as SubscriptionContext, topic is given by path segments
+func (c *Client) SubscriptionPath(ctx context.Context, segments []string) (chan []byte, error) {
+	topic, err := TopicPath(segments)
+	if err != nil {
+		return nil, err
+	}
+	return c.SubscriptionContext(ctx, topic)
+}
+
+//Same as RemoveTopicContext, topic is given by path segments
+func (c *Client) RemoveTopicPath(ctx context.Context, segments []string) error {
+	topic, err := TopicPath(segments)
+	if err != nil {
+		return err
+	}
+	return c.RemoveTopicContext(ctx, topic)
+}
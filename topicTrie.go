@@ -0,0 +1,162 @@
+package coapmq
+
+import "strings"
+
+//Wildcard in topic filter, "+" match exactly one level and "#" match all remain levels
+const (
+	WILDCARD_SINGLE = "+"
+	WILDCARD_MULTI  = "#"
+)
+
+//Trie to index subscriptions by topic filter, such as "sensors/+/temperature" or "sensors/#"
+//It is not thread safe, caller need hold the broker lock.
+type topicTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	//Subscriber ID subscribe with the filter end on this node
+	clients []string
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTrieNode()}
+}
+
+//Add client on topic filter, return false if client already exist
+func (t *topicTrie) add(filter string, client string) bool {
+	node := t.root
+	for _, seg := range strings.Split(filter, "/") {
+		child, exist := node.children[seg]
+		if !exist {
+			child = newTrieNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+
+	if ContainString(node.clients, client) {
+		return false
+	}
+	node.clients = append(node.clients, client)
+	return true
+}
+
+//Remove client from topic filter, return false if not found
+func (t *topicTrie) remove(filter string, client string) bool {
+	return t.removeNode(t.root, strings.Split(filter, "/"), client)
+}
+
+func (t *topicTrie) removeNode(node *trieNode, segs []string, client string) bool {
+	if len(segs) == 0 {
+		if !ContainString(node.clients, client) {
+			return false
+		}
+		node.clients = RemoveStringFromSlice(node.clients, client)
+		return true
+	}
+
+	child, exist := node.children[segs[0]]
+	if !exist {
+		return false
+	}
+	removed := t.removeNode(child, segs[1:], client)
+	//Prune empty branch
+	if len(child.clients) == 0 && len(child.children) == 0 {
+		delete(node.children, segs[0])
+	}
+	return removed
+}
+
+//Return all clients subscribe on the exact filter
+func (t *topicTrie) subscribers(filter string) []string {
+	node := t.root
+	for _, seg := range strings.Split(filter, "/") {
+		child, exist := node.children[seg]
+		if !exist {
+			return nil
+		}
+		node = child
+	}
+	return append([]string(nil), node.clients...)
+}
+
+//Return all clients which filter match the topic, each client only return once
+func (t *topicTrie) match(topic string) []string {
+	var clients []string
+	t.matchNode(t.root, strings.Split(topic, "/"), func(node *trieNode) {
+		for _, client := range node.clients {
+			if !ContainString(clients, client) {
+				clients = append(clients, client)
+			}
+		}
+	})
+	return clients
+}
+
+func (t *topicTrie) matchNode(node *trieNode, segs []string, found func(*trieNode)) {
+	//"#" also match parent level, "sensors/#" match "sensors"
+	if child, exist := node.children[WILDCARD_MULTI]; exist {
+		found(child)
+	}
+	if len(segs) == 0 {
+		found(node)
+		return
+	}
+
+	if child, exist := node.children[segs[0]]; exist {
+		t.matchNode(child, segs[1:], found)
+	}
+	if child, exist := node.children[WILDCARD_SINGLE]; exist {
+		t.matchNode(child, segs[1:], found)
+	}
+}
+
+//Walk all filters which has subscriber
+func (t *topicTrie) walk(fn func(filter string, clients []string)) {
+	t.walkNode(t.root, nil, fn)
+}
+
+func (t *topicTrie) walkNode(node *trieNode, segs []string, fn func(string, []string)) {
+	if len(node.clients) > 0 {
+		fn(JoinTopic(segs), node.clients)
+	}
+	for seg, child := range node.children {
+		t.walkNode(child, append(segs[:len(segs):len(segs)], seg), fn)
+	}
+}
+
+//Check if topic filter is valid, "+" must be a whole level and "#" must be the last level
+func ValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	segs := strings.Split(filter, "/")
+	for k, seg := range segs {
+		if seg == "" {
+			return false
+		}
+		if seg == WILDCARD_MULTI && k != len(segs)-1 {
+			return false
+		}
+		if seg != WILDCARD_SINGLE && seg != WILDCARD_MULTI && strings.ContainsAny(seg, WILDCARD_SINGLE+WILDCARD_MULTI) {
+			return false
+		}
+	}
+	return true
+}
+
+//Check if topic filter contain any wildcard
+func IsWildcardFilter(filter string) bool {
+	for _, seg := range strings.Split(filter, "/") {
+		if seg == WILDCARD_SINGLE || seg == WILDCARD_MULTI {
+			return true
+		}
+	}
+	return false
+}
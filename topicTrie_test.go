@@ -0,0 +1,33 @@
+package coapmq_test
+
+import (
+	"testing"
+
+	. "github.com/kkdai/coapmq"
+)
+
+func TestValidTopicFilter(t *testing.T) {
+	cases := map[string]bool{
+		"sensors":               true,
+		"sensors/+/temperature": true,
+		"sensors/#":             true,
+		"+/+":                   true,
+		"#":                     true,
+		"sensors/#/temperature": false,
+		"sensors/te+":           false,
+		"sensors//temperature":  false,
+		"":                      false,
+	}
+	for filter, valid := range cases {
+		if ValidTopicFilter(filter) != valid {
+			t.Error("Valid topic filter failed:", filter)
+		}
+	}
+
+	if IsWildcardFilter("sensors/temperature") || !IsWildcardFilter("sensors/+") {
+		t.Error("Wildcard filter check failed")
+	}
+	if ValidTopic("sensors/+") {
+		t.Error("Topic should not include wildcard")
+	}
+}